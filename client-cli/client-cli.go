@@ -33,6 +33,11 @@ func NewConnection(packet *layers.TCP) Connection {
 	return Connection{src: packet.SrcPort, dst: packet.DstPort}
 }
 
+// Connection id sent along with training packets so that payloads from the same connection can be grouped.
+func (conn Connection) ID() uint64 {
+	return uint64(conn.src)<<16 | uint64(conn.dst)
+}
+
 // Return true if either the src or dst port matches the requested port.
 func (conn Connection) CheckPort(port layers.TCPPort) bool {
 	return conn.src == port || conn.dst == port
@@ -67,13 +72,60 @@ func main() {
 		}
 	} else if mode == "rules" {
 		// Note that captureName is never initialized.
-		rules(captureName)
+		rules(captureName, os.Args[2])
+	} else if mode == "top" {
+		top(os.Args[2])
 	} else {
 		// Print usage help.
 		usage()
 	}
 }
 
+// The lab's address and options, from the environment.  ADVERSARYLAB_HOST is where the lab is
+// running, localhost by default.  ADVERSARYLAB_TOKEN is sent with every request for labs that are
+// run with an ACL.  Setting ADVERSARYLAB_CA, the CA that signed the lab's certificate, turns on
+// TLS, and ADVERSARYLAB_CERT and ADVERSARYLAB_KEY are the client certificate for labs that
+// require one.
+func labOptions() (func(port int) string, protocol.Options) {
+	options := protocol.DefaultOptions()
+	options.Token = os.Getenv("ADVERSARYLAB_TOKEN")
+
+	host := os.Getenv("ADVERSARYLAB_HOST")
+	if host == "" {
+		host = "localhost"
+	}
+
+	scheme := "tcp://"
+	if ca := os.Getenv("ADVERSARYLAB_CA"); ca != "" {
+		config, err := protocol.ClientTLSConfig(ca, os.Getenv("ADVERSARYLAB_CERT"), os.Getenv("ADVERSARYLAB_KEY"))
+		if err != nil {
+			fmt.Println("Error loading certificates", err)
+			os.Exit(1)
+		}
+
+		options.TLSConfig = config
+		scheme = "tls+tcp://"
+	}
+
+	address := func(port int) string {
+		return fmt.Sprintf("%s%s:%d", scheme, host, port)
+	}
+
+	return address, options
+}
+
+// Connect to one of the lab's request sockets, exiting if it can't be reached.
+func connect(port int) protocol.Client {
+	address, options := labOptions()
+	lab, err := protocol.Dial(address(port), options)
+	if err != nil {
+		fmt.Println("Error connecting to the lab", err)
+		os.Exit(1)
+	}
+
+	return lab
+}
+
 // Capture packets for training. Classify as a specific dataset and allow/block on a given port.
 func capture(dataset string, allowBlock bool, port *string) {
 	var lab protocol.Client
@@ -90,7 +142,7 @@ func capture(dataset string, allowBlock bool, port *string) {
 
 	// Creates the client socket for sending training packets.  Is connected to the server
 	// socket listening on tcp://localhost:4567.
-	lab = protocol.Connect("tcp://localhost:4567")
+	lab = connect(4567)
 
 	// Records captured packets as the values in a map, where keys are the dst/src port.  This
 	// map structure is used rather than a set to retain packages captured when the desired
@@ -194,9 +246,39 @@ func usage() {
 	fmt.Println()
 	fmt.Println("client-cli rules [protocol]")
 	fmt.Println("Example: client-client rules HTTP")
+	fmt.Println()
+	fmt.Println("client-cli top [dataset]")
+	fmt.Println("Example: client-cli top testing")
 	os.Exit(1)
 }
 
+// Print the best rules found so far for both directions of a dataset, best first.
+func top(dataset string) {
+	lab := connect(4567)
+
+	for _, incoming := range []bool{true, false} {
+		direction := "outgoing"
+		if incoming {
+			direction = "incoming"
+		}
+
+		rules, err := lab.GetTopRules(dataset, incoming)
+		if err != nil {
+			fmt.Println("Error getting rules", err)
+			os.Exit(1)
+		}
+
+		fmt.Println(dataset, direction)
+		for rank, rule := range rules {
+			action := "block"
+			if rule.RequireForbid {
+				action = "allow"
+			}
+			fmt.Printf("%d. %s offset %d %q score %.3f allow %d/%d block %d/%d\n", rank+1, action, rule.Offset(), rule.Subsequence(), rule.Score, rule.AllowCount, rule.AllowTotal, rule.BlockCount, rule.BlockTotal)
+		}
+	}
+}
+
 // Example:
 // {"OpenVPN" : {
 //   "name":"OpenVPN",
@@ -206,7 +288,9 @@ func usage() {
 //       "action":"block",
 //       "outgoing": [72, 84, 84, 80, 47, 49, 46, 49, 32, 50, 48, 48, 32,
 // 79, 75, 13, 10],
-//       "incoming": [71, 69, 84, 32, 47]}]}}
+//       "outgoing_offset": 0,
+//       "incoming": [71, 69, 84, 32, 47],
+//       "incoming_offset": 0}]}}
 type RuleSet struct {
 	name           string
 	target         string
@@ -215,12 +299,21 @@ type RuleSet struct {
 
 type Rule map[string]interface{}
 
-// captureName is never set. Listen for rules as a subscriber, and create and update a cache
-// of both incoming and outgoing rules for each dataset.
-func rules(captureName string) {
+// captureName is never set. Listen for rules for the dataset as a subscriber, and create and update
+// a cache of both incoming and outgoing rules.
+func rules(captureName string, dataset string) {
 	var lab protocol.PubsubClient
 
-	lab = protocol.PubsubConnect("tcp://localhost:4568")	// returns both client socket and decoded rules chanel
+	// returns both client socket and decoded rules chanel, starting with the current rules
+	address, options := labOptions()
+	options.OnError = func(err error) {
+		fmt.Println("Error receiving rules", err)
+	}
+	lab, err := protocol.PubsubDialWithSnapshot(address(4568), address(4570), []string{dataset}, options)
+	if err != nil {
+		fmt.Println("Error connecting to the lab", err)
+		os.Exit(1)
+	}
 
 	// Make a map that will have dataset keys (ex. "dataset1") mapping to values that are 2d arrays.
 	// The first row in the array is the incoming rule sequence (offset+byte subsequence)
@@ -240,22 +333,28 @@ func rules(captureName string) {
 		}
 
 		// Place the rule sequence in the appropriate row of the entry, overwriting if necessary.
-		if currentRule.Incoming {
-			entry[0] = currentRule.Sequence
-		} else {
-			entry[1] = currentRule.Sequence
+		// Rules sent before the server has a best sequence only have the bytemap prefixes.
+		if len(currentRule.Sequence) > 0 {
+			if currentRule.Incoming {
+				entry[0] = currentRule.Sequence
+			} else {
+				entry[1] = currentRule.Sequence
+			}
 		}
 
 		cache[name] = entry
 
-		// Convert the bytes in the rules to ints for better readability.
-		outgoingBytes := entry[1]
+		// Convert the bytes in the rules to ints for better readability.  The offset is reported
+		// separately from the bytes that are expected at that offset.
+		outgoingRule := protocol.Rule{Sequence: entry[1]}
+		outgoingBytes := outgoingRule.Subsequence()
 		outgoingInts := make([]int, len(outgoingBytes))
 		for index, value := range outgoingBytes {
 			outgoingInts[index] = int(value)
 		}
 
-		incomingBytes := entry[0]
+		incomingRule := protocol.Rule{Sequence: entry[0]}
+		incomingBytes := incomingRule.Subsequence()
 		incomingInts := make([]int, len(incomingBytes))
 		for index, value := range incomingBytes {
 			incomingInts[index] = int(value)
@@ -263,11 +362,13 @@ func rules(captureName string) {
 
 		// FIXME - use RequireForbid field
 		// Note that this marks all rules as block (undesirable)
-		rule := make(map[string]interface{}, 4)
+		rule := make(map[string]interface{}, 6)
 		rule["rule_type"] = "adversary labs"
 		rule["action"] = "block"
 		rule["outgoing"] = outgoingInts
+		rule["outgoing_offset"] = outgoingRule.Offset()
 		rule["incoming"] = incomingInts
+		rule["incoming_offset"] = incomingRule.Offset()
 
 		rules := make([]Rule, 1)
 		rules[0] = rule
@@ -438,11 +539,19 @@ func saveCaptured(lab protocol.Client, dataset string, allowBlock bool, stopCapt
 			fmt.Print("*")
 			if app := packet.ApplicationLayer(); app != nil {
 				fmt.Print("$")
-				incoming := packet.Layer(layers.LayerTypeTCP).(*layers.TCP).DstPort == port
+				tcp := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+				incoming := tcp.DstPort == port
 				data := app.Payload()
 				fmt.Println()
 				fmt.Println(data)
-				lab.AddTrainPacket(dataset, allowBlock, incoming, data)
+				trainPacket := protocol.TrainPacket{Dataset: dataset, AllowBlock: allowBlock, Incoming: incoming, Payload: data, Connection: NewConnection(tcp).ID()}
+				if metadata := packet.Metadata(); metadata != nil {
+					trainPacket.Timestamp = metadata.Timestamp.UnixNano()
+				}
+				// Keep capturing if one packet is rejected, but make it obvious.
+				if _, err := lab.SendTrainPacket(trainPacket); err != nil {
+					fmt.Println("Error adding training packet", err)
+				}
 			}
 		}
 	}
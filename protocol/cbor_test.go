@@ -50,3 +50,373 @@ func TestStruct(t *testing.T) {
 	t.Log(value)
 	t.Log(buff.Bytes())
 }
+
+func TestRuleTopic(t *testing.T) {
+	rule := Rule{Dataset: "HTTP", Incoming: true, Sequence: []byte{0, 0, 'G', 'E', 'T'}}
+
+	encoded, err := EncodeNamedType("protocol.Rule", rule)
+	if err != nil {
+		t.Fatal("Error encoding rule: " + err.Error())
+	}
+	if encoded[0] != 0xd8 {
+		t.Error("Encoded rule doesn't start with the NamedType tag", encoded[0])
+	}
+
+	for _, msg := range [][]byte{append(RuleTopic("HTTP", true), encoded...), encoded} {
+		_, body := splitTopic(msg)
+
+		_, value, err := DecodeMessage(body)
+		if err != nil {
+			t.Fatal("Error decoding rule: " + err.Error())
+		}
+
+		decoded := value.(Rule)
+		if decoded.Dataset != "HTTP" || !decoded.Incoming || decoded.Offset() != 0 || string(decoded.Subsequence()) != "GET" {
+			t.Error("Wrong rule", decoded)
+		}
+	}
+
+	if bytes.HasPrefix(RuleTopic("HTTP10", true), RuleTopic("HTTP1", true)) {
+		t.Error("Topic for one dataset matches another")
+	}
+}
+
+func TestResponse(t *testing.T) {
+	top := TopRules{Dataset: "HTTP", Incoming: true, Rules: []Rule{{Dataset: "HTTP", Incoming: true, Sequence: []byte{0, 0, 'G'}, AllowCount: 3}}}
+
+	encoded := EncodeResponse(NewResponse(top))
+	response, err := DecodeResponse(encoded)
+	if err != nil {
+		t.Fatal("Error decoding response: " + err.Error())
+	}
+
+	var decoded TopRules
+	if err = decodeValue(encoded, &Response{Value: &decoded}); err != nil {
+		t.Fatal("Error decoding response value: " + err.Error())
+	}
+	if response.Index != -1 || len(decoded.Rules) != 1 || decoded.Rules[0].AllowCount != 3 {
+		t.Error("Wrong response", response)
+	}
+
+	failed := ErrorResponse(StoreFailed, "disk full")
+	failed.Index = 7
+	response, err = DecodeResponse(EncodeResponse(failed))
+	if responseErr, ok := err.(ResponseError); !ok || responseErr.Status != StoreFailed || responseErr.Message != "disk full" {
+		t.Error("Wrong error", err)
+	}
+	if response.Index != 7 {
+		t.Error("Wrong index", response.Index)
+	}
+
+	// Older servers answer everything with "success".
+	response, err = DecodeResponse([]byte("success"))
+	if err != nil || response.Status != Success || response.Value != nil {
+		t.Error("Wrong response to an older server", response, err)
+	}
+}
+
+func TestTrainBatch(t *testing.T) {
+	batch := TrainBatch{Packets: []TrainPacket{
+		{Dataset: "HTTP", AllowBlock: true, Incoming: true, Payload: []byte("GET /")},
+		{Dataset: "TLS", AllowBlock: false, Incoming: false, Payload: []byte{22, 3, 1}, Timestamp: 1500000000000000000, Connection: 443},
+	}}
+
+	encoded, err := EncodeNamedType("protocol.TrainBatch", batch)
+	if err != nil {
+		t.Fatal("Error encoding batch: " + err.Error())
+	}
+
+	_, value, err := DecodeMessage(encoded)
+	if err != nil {
+		t.Fatal("Error decoding batch: " + err.Error())
+	}
+
+	decoded := value.(TrainBatch)
+	if len(decoded.Packets) != 2 || decoded.Packets[0].Dataset != "HTTP" || !decoded.Packets[0].AllowBlock || string(decoded.Packets[0].Payload) != "GET /" {
+		t.Error("Wrong first packet", decoded.Packets)
+	}
+	if decoded.Packets[1].Timestamp != 1500000000000000000 || decoded.Packets[1].Connection != 443 {
+		t.Error("Wrong second packet", decoded.Packets)
+	}
+
+	// Packets that weren't stored have an index of -1.
+	response := ErrorResponse(InvalidRequest, "Training packet has no payload")
+	response.Value = []int64{12, -1}
+	var indices []int64
+	decodeValue(EncodeResponse(response), &Response{Value: &indices})
+	if len(indices) != 2 || indices[0] != 12 || indices[1] != -1 {
+		t.Error("Wrong indices", indices)
+	}
+}
+
+func TestDecodeMalformedMessage(t *testing.T) {
+	// A field with the wrong type is an error rather than a panic.
+	encoded, _ := EncodeNamedType("protocol.TrainPacket", map[string]interface{}{"Dataset": 7, "Payload": "GET"})
+	if _, _, err := DecodeMessage(encoded); err == nil {
+		t.Error("Decoded a TrainPacket with a number for its dataset")
+	}
+
+	// Missing fields are left as zero values, which is how older clients are handled.
+	encoded, _ = EncodeNamedType("protocol.TrainPacket", map[string]interface{}{"Dataset": "HTTP", "Payload": []byte("GET")})
+	_, value, err := DecodeMessage(encoded)
+	if packet, ok := value.(TrainPacket); err != nil || !ok || packet.Dataset != "HTTP" || packet.Timestamp != 0 {
+		t.Error("Wrong packet from an older client", value, err)
+	}
+
+	encoded, _ = EncodeNamedType("protocol.Unknown", TrainPacket{})
+	if _, _, err := DecodeMessage(encoded); err == nil {
+		t.Error("Decoded an unknown message")
+	} else if _, ok := err.(UnknownMessageError); !ok {
+		t.Error("Wrong error for an unknown message", err)
+	}
+
+	for _, garbage := range [][]byte{nil, []byte("success"), {0xd8, 0x4e, 0x01}, {0xd8, 0x4e, 0xa1, 0x64, 'N', 'a', 'm', 'e'}} {
+		if _, _, err := DecodeMessage(garbage); err == nil {
+			t.Error("Decoded garbage", garbage)
+		}
+	}
+}
+
+func TestRuleBlocks(t *testing.T) {
+	// Block payloads with "GET" at offset 1.
+	rule := Rule{Sequence: []byte{1, 0, 'G', 'E', 'T'}}
+	if !rule.Blocks([]byte(" GET /")) || rule.Blocks([]byte("GET /")) || rule.Blocks([]byte(" GE")) {
+		t.Error("Wrong decisions for a block rule")
+	}
+
+	// Allow only payloads with "GET" at offset 1.
+	rule.RequireForbid = true
+	if rule.Blocks([]byte(" GET /")) || !rule.Blocks([]byte("GET /")) {
+		t.Error("Wrong decisions for an allow rule")
+	}
+
+	stats := TestStats{}
+	stats.Add(TestResult{Tested: true, Blocked: true}, false)
+	stats.Add(TestResult{Tested: true, Blocked: true}, true)
+	stats.Add(TestResult{Tested: true, Blocked: false}, true)
+	stats.Add(TestResult{Tested: true, Blocked: false}, false)
+	stats.Add(TestResult{Tested: false}, true)
+	if stats.TruePositives != 1 || stats.FalsePositives != 1 || stats.TrueNegatives != 1 || stats.FalseNegatives != 1 || stats.Untested != 1 {
+		t.Error("Wrong stats", stats)
+	}
+}
+
+// Encode a message the way clients from before versions were added did.
+func encodeVersion0(name string, value interface{}) []byte {
+	var b []byte
+	codec.NewEncoderBytes(&b, new(codec.CborHandle)).Encode(struct {
+		Name  string
+		Value interface{}
+	}{Name: name, Value: value})
+	return append([]byte{0xd8, 78}, b...)
+}
+
+func TestVersion(t *testing.T) {
+	encoded, _ := EncodeNamedType("protocol.Hello", ServerHello())
+	named, err := DecodeNamedType(encoded)
+	if err != nil || named.Version != ProtocolVersion {
+		t.Error("Wrong version", named.Version, err)
+	}
+
+	// Older training packets are translated.
+	_, value, err := DecodeMessage(encodeVersion0("protocol.TrainPacket", map[string]interface{}{"Dataset": "HTTP", "AllowBlock": true, "Incoming": true, "Payload": []byte("GET")}))
+	if packet, ok := value.(TrainPacket); err != nil || !ok || !packet.AllowBlock || packet.Dataset != "HTTP" {
+		t.Error("Wrong version 0 training packet", value, err)
+	}
+
+	// Older clients sent unlabeled test packets as training packets, which are rejected.
+	_, _, err = DecodeMessage(encodeVersion0("protocol.TrainPacket", map[string]interface{}{"Dataset": "HTTP", "Incoming": true, "Payload": []byte("GET")}))
+	if _, ok := err.(VersionError); !ok {
+		t.Error("Wrong error for a version 0 test packet", err)
+	}
+	if DecodeErrorResponse(err).Status != UnsupportedVersion {
+		t.Error("Wrong status for a version 0 test packet")
+	}
+
+	// Servers reject requests from versions that don't exist yet, since they can't answer them.
+	encoded = encodeVersion0("protocol.Hello", Hello{})
+	var raw RawNamedType
+	codec.NewDecoderBytes(encoded[2:], new(codec.CborHandle)).Decode(&raw)
+	raw.Version = ProtocolVersion + 1
+	var b []byte
+	codec.NewEncoderBytes(&b, new(codec.CborHandle)).Encode(raw)
+	request, err := DecodeRequest(append([]byte{0xd8, 78}, b...))
+	if _, ok := err.(VersionError); !ok {
+		t.Error("Decoded a request from a newer version", err)
+	}
+
+	// They are still answered in a version the client might understand.
+	named, _ = DecodeNamedType(request.Reply(DecodeErrorResponse(err)))
+	if named.Version != ProtocolVersion {
+		t.Error("Wrong version for the reply to a newer client", named.Version)
+	}
+
+	// Clients read messages from newer servers, ignoring what they don't know about.
+	if _, _, err = DecodeMessage(append([]byte{0xd8, 78}, b...)); err != nil {
+		t.Error("Couldn't decode a message from a newer version", err)
+	}
+}
+
+// What a Response might look like in the next version, with Index renamed and a field added.
+type nextResponse struct {
+	Status     ResultStatus
+	Error      string
+	Position   int64
+	Value      interface{}
+	RetryAfter int64
+}
+
+// A server one version ahead answers a client on this version.
+func TestNewerServer(t *testing.T) {
+	next := ProtocolVersion + 1
+	downgrades[next] = map[string]Translation{
+		"protocol.Response": func(value map[interface{}]interface{}) (string, map[interface{}]interface{}, error) {
+			value["Index"] = value["Position"]
+			delete(value, "Position")
+			return "protocol.Response", value, nil
+		},
+	}
+	defer delete(downgrades, next)
+
+	encoded, err := EncodeRequest("protocol.Hello", Hello{Version: ProtocolVersion, MinVersion: MinProtocolVersion}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := DecodeRequest(encoded)
+	if err != nil || request.Version != ProtocolVersion {
+		t.Fatal("Wrong request", request, err)
+	}
+
+	// The reply is in the client's version, with the renamed field translated back.
+	reply, err := encodeVersion("protocol.Response", nextResponse{Status: Success, Position: 42, Value: Hello{Version: next}, RetryAfter: 5}, "", next, request.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	named, err := DecodeNamedType(reply)
+	if err != nil || named.Version != ProtocolVersion {
+		t.Error("Wrong version for the reply", named.Version, err)
+	}
+
+	response, err := DecodeResponse(reply)
+	if err != nil || response.Index != 42 {
+		t.Error("Wrong response from a newer server", response, err)
+	}
+	var hello Hello
+	if decodeValue(reply, &Response{Value: &hello}) != nil || hello.Version != next {
+		t.Error("Wrong Hello from a newer server", hello)
+	}
+
+	// Without a downgrade, the client still reads the fields it knows about.
+	reply, _ = encodeVersion("protocol.Response", nextResponse{Status: Busy, Error: "busy", Position: 42, RetryAfter: 5}, "", next, next)
+	response, err = DecodeResponse(reply)
+	if _, ok := err.(ResponseError); !ok || response.Status != Busy || response.Index != 0 {
+		t.Error("Wrong response in a newer version", response, err)
+	}
+}
+
+// Responses and their values are translated down for older clients.
+func TestReplyVersion(t *testing.T) {
+	downgrades[ProtocolVersion] = map[string]Translation{
+		"protocol.Rule": func(value map[interface{}]interface{}) (string, map[interface{}]interface{}, error) {
+			value["Sequence"] = value["AllowPrefix"]
+			return "protocol.Rule", value, nil
+		},
+	}
+	defer delete(downgrades, ProtocolVersion)
+
+	rule := Rule{Dataset: "HTTP", Incoming: true, Sequence: []byte("GET"), AllowPrefix: []byte("POST")}
+	tests := []struct {
+		version  int
+		reply    int
+		sequence string
+	}{
+		{ProtocolVersion + 1, ProtocolVersion, "GET"},
+		{ProtocolVersion, ProtocolVersion, "GET"},
+		{ProtocolVersion - 1, ProtocolVersion - 1, "POST"},
+		{MinProtocolVersion - 1, MinProtocolVersion, "POST"},
+	}
+
+	for _, test := range tests {
+		reply := Request{Version: test.version}.Reply(NewResponse(&rule))
+		named, err := DecodeNamedType(reply)
+		if err != nil || named.Version != test.reply {
+			t.Error("Wrong reply version", test.version, named.Version, err)
+		}
+
+		var decoded Rule
+		if decodeValue(reply, &Response{Value: &decoded}) != nil || decoded.Dataset != "HTTP" || string(decoded.Sequence) != test.sequence {
+			t.Error("Wrong rule in reply", test.version, decoded)
+		}
+	}
+
+	// Rules are published in the oldest version.
+	encoded, err := EncodeVersion("protocol.Rule", rule, "", MinProtocolVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, value, err := DecodeMessage(encoded)
+	if decoded, ok := value.(Rule); err != nil || !ok || string(decoded.Sequence) != "POST" {
+		t.Error("Wrong published rule", value, err)
+	}
+}
+
+func TestRequestToken(t *testing.T) {
+	encoded, _ := EncodeRequest("protocol.TrainPacket", TrainPacket{Dataset: "HTTP", AllowBlock: true, Payload: []byte("GET")}, "secret")
+	request, err := DecodeRequest(encoded)
+	if err != nil || request.Token != "secret" || request.Name != "protocol.TrainPacket" {
+		t.Error("Wrong request", request, err)
+	}
+	if packet, ok := request.Value.(TrainPacket); !ok || packet.Dataset != "HTTP" {
+		t.Error("Wrong training packet", request.Value)
+	}
+
+	// Messages from older clients don't have a token.
+	request, err = DecodeRequest(encodeVersion0("protocol.Hello", Hello{}))
+	if err != nil || request.Token != "" {
+		t.Error("Wrong token for a version 0 message", request.Token, err)
+	}
+}
+
+// Older versions of the codec pass NamedTypeExt values and maps, newer ones pass pointers and
+// the RawNamedType returned by ConvertExt.
+func TestNamedTypeExt(t *testing.T) {
+	var ext NamedTypeExt
+	named := NamedType{Name: "protocol.Hello", Value: Hello{Version: 1}, Version: 1, Token: "secret"}
+	expected := RawNamedType{Name: "protocol.Hello", Value: Hello{Version: 1}, Version: 1, Token: "secret"}
+
+	for _, value := range []interface{}{named, &named} {
+		if raw, ok := ext.ConvertExt(value).(RawNamedType); !ok || raw != expected {
+			t.Errorf("Wrong conversion of %T", value)
+		}
+	}
+
+	updates := []interface{}{
+		map[interface{}]interface{}{"Name": "protocol.Hello", "Value": Hello{Version: 1}, "Version": uint64(1), "Token": "secret"},
+		map[interface{}]interface{}{"Name": "protocol.Hello", "Value": Hello{Version: 1}, "Version": int64(1), "Token": "secret"},
+		expected,
+	}
+	for _, value := range updates {
+		var decoded NamedType
+		ext.UpdateExt(&decoded, value)
+		if decoded != named {
+			t.Errorf("Wrong update from %T: %v", value, decoded)
+		}
+	}
+
+	// Anything else is a NamedType without a name.
+	decoded := named
+	ext.UpdateExt(&decoded, "protocol.Hello")
+	if decoded != (NamedType{}) {
+		t.Error("Wrong update from a string", decoded)
+	}
+
+	// Whichever the codec uses, a NamedType survives a round trip.
+	encoded, err := EncodeRequest("protocol.Hello", Hello{Version: 1}, "secret")
+	if err != nil {
+		t.Fatal("Error encoding NamedType", err)
+	}
+	decoded, err = DecodeNamedType(encoded)
+	if err != nil || decoded.Name != "protocol.Hello" || decoded.Version != ProtocolVersion || decoded.Token != "secret" {
+		t.Error("Wrong round trip", decoded, err)
+	}
+}
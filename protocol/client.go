@@ -9,40 +9,76 @@ import (
 
 	"github.com/go-mangos/mangos"
 	"github.com/go-mangos/mangos/protocol/req"
-	"github.com/go-mangos/mangos/transport/tcp"
 )
 
 type Client struct {
-	sock mangos.Socket
+	sock  mangos.Socket
+	token string // Options.Token, sent with every request
 }
 
-// Creates a new client socket for sending training packets.
+// Creates a new client socket for sending training packets.  Exits if the server can't be
+// reached, so it's meant for the command line tools.  Programs that keep running should use Dial.
 func Connect(url string) Client {
+	client, err := Dial(url, DefaultOptions())
+	if err != nil {
+		die("can't dial on req socket: %s", err.Error())
+	}
+
+	return client
+}
+
+// Creates a new client socket for sending training packets and connects it to the server.  If
+// the connection is lost later, it is redialed in the background.
+func Dial(url string, options Options) (Client, error) {
 	var sock mangos.Socket
 	var err error
 
 	if sock, err = req.NewSocket(); err != nil {
-		die("can't get new req socket: %s", err.Error())
+		return Client{}, err
 	}
 
-	sock.AddTransport(tcp.NewTransport())
+	// Requests that aren't answered in time fail instead of waiting forever.
+	if options.Timeout > 0 {
+		err = sock.SetOption(mangos.OptionSendDeadline, options.Timeout)
+		if err == nil {
+			err = sock.SetOption(mangos.OptionRecvDeadline, options.Timeout)
+		}
+	}
 
 	// Connect the socket to the listening socket on the server.
-	if err = sock.Dial(url); err != nil {
-		die("can't dial on req socket: %s", err.Error())
+	if err == nil {
+		err = dialSocket(sock, url, options)
+	}
+	if err != nil {
+		sock.Close()
+		return Client{}, err
 	}
 
 	return Client{
-		sock: sock,
-	}
+		sock:  sock,
+		token: options.Token,
+	}, nil
+}
+
+// Close the connection to the server.
+func (self Client) Close() error {
+	return self.sock.Close()
 }
 
 // Called from client-cli.go when there is a packet involving the requested port.  The payload is the
 // application payload, incoming is true if the packet dst port matched the requested port.
-func (self Client) AddTrainPacket(dataset string, allowBlock bool, incoming bool, payload []byte) {
+// Returns the index the packet was stored at.
+func (self Client) AddTrainPacket(dataset string, allowBlock bool, incoming bool, payload []byte) (int64, error) {
 	var packet TrainPacket = TrainPacket{Dataset: dataset, AllowBlock: allowBlock, Incoming: incoming, Payload: payload}
 
-	var value = NamedType{Name: "protocol.TrainPacket", Value: packet}
+	return self.SendTrainPacket(packet)
+}
+
+// Send a training packet that has been filled in by the caller, such as one that includes
+// the capture time and connection id.  Returns the index the packet was stored at, or an error
+// if the server couldn't store it.
+func (self Client) SendTrainPacket(packet TrainPacket) (int64, error) {
+	var value = NamedType{Name: "protocol.TrainPacket", Value: packet, Version: ProtocolVersion, Token: self.token}
 
 	// A Buffer is a variable-sized buffer of bytes with Read and Write methods.
 	// The zero value for Buffer is an empty buffer ready to use.
@@ -59,77 +95,170 @@ func (self Client) AddTrainPacket(dataset string, allowBlock bool, incoming bool
 	var enc *codec.Encoder = codec.NewEncoder(bw, h)
 	var err error = enc.Encode(value)  // Encode writes an object into a stream.
 	if err != nil {
-		die("Error encoding packet: %s", err.Error())
+		return -1, err
 	}
 
 	// Flush writes any buffered data to the underlying io.Writer.
 	bw.Flush()
 
-	self.request(buff.Bytes())
-}
+	reply, err := self.request(buff.Bytes())
+	if err != nil {
+		return -1, err
+	}
 
-func (self Client) AddTestPacket(dataset string, incoming bool, payload []byte) {
-	var packet TestPacket = TestPacket{Dataset: dataset, Incoming: incoming, Payload: payload}
+	response, err := DecodeResponse(reply)
+	if err != nil {
+		return -1, err
+	}
 
-	var value = NamedType{Name: "protocol.TrainPacket", Value: packet}
+	return response.Index, nil
+}
 
-	var buff = new(bytes.Buffer)
-	var bw = bufio.NewWriter(buff)
-	//  var b []byte = make([]byte, 0, 2048)
-	var h codec.Handle = NamedTypeHandle()
+// Send many training packets in one request, which is much faster than sending them one at a
+// time.  The packets can be for different datasets and directions.  Returns the index each packet
+// was stored at, in the same order.  If some of the packets couldn't be stored, their indices are
+// -1 and the error says why the first of them failed.  The whole request has to fit in
+// MaxRequestSize, so split large imports into batches of a few thousand packets.
+func (self Client) AddTrainPackets(packets []TrainPacket) ([]int64, error) {
+	data, err := EncodeRequest("protocol.TrainBatch", TrainBatch{Packets: packets}, self.token)
+	if err != nil {
+		return nil, err
+	}
 
-	//  var enc *codec.Encoder = codec.NewEncoderBytes(&b, h)
-	var enc *codec.Encoder = codec.NewEncoder(bw, h)
-	var err error = enc.Encode(value)
+	reply, err := self.request(data)
 	if err != nil {
-		die("Error encoding packet: %s", err.Error())
+		return nil, err
 	}
 
-	bw.Flush()
+	response, err := DecodeResponse(reply)
+	if _, failed := err.(ResponseError); err != nil && !failed {
+		return nil, err
+	}
+
+	var indices []int64
+	if response.Value != nil {
+		if decodeErr := decodeValue(reply, &Response{Value: &indices}); decodeErr != nil {
+			return nil, decodeErr
+		}
+	}
 
-	self.request(buff.Bytes())
+	return indices, err
 }
 
-func (self Client) GetIncomingRule(dataset string) []byte {
-	var request RuleRequest = RuleRequest{Dataset: dataset, Incoming: true}
-	var b []byte = make([]byte, 0, 64)
-	var h codec.Handle = new(codec.CborHandle)
-	var enc *codec.Encoder = codec.NewEncoderBytes(&b, h)
-	var err error = enc.Encode(request)
+// Check the current rule for a dataset and direction against a packet of held-out traffic, on the
+// test service at tcp://localhost:4569.  allowBlock is true if the packet should be allowed.  The
+// packet isn't trained on.  Returns the rule's decision, which is also added to the test stats.
+func (self Client) AddTestPacket(dataset string, allowBlock bool, incoming bool, payload []byte) (*TestResult, error) {
+	var packet TestPacket = TestPacket{Dataset: dataset, AllowBlock: allowBlock, Incoming: incoming, Payload: payload}
+
+	var result TestResult
+	_, err := self.call("protocol.TestPacket", packet, &result)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 
-	return self.request(b)
+	return &result, nil
 }
 
-func (self Client) GetOutgoingRule(dataset string) []byte {
-	var request RuleRequest = RuleRequest{Dataset: dataset, Incoming: false}
-	var b []byte = make([]byte, 0, 64)
-	var h codec.Handle = new(codec.CborHandle)
-	var enc *codec.Encoder = codec.NewEncoderBytes(&b, h)
-	var err error = enc.Encode(request)
+// Get the counts of the decisions the rules made for the test packets of a dataset and direction,
+// from the test service.
+func (self Client) GetTestStats(dataset string, incoming bool) (*TestStats, error) {
+	var stats TestStats
+	_, err := self.call("protocol.TestStatsRequest", TestStatsRequest{Dataset: dataset, Incoming: incoming}, &stats)
+	if err != nil {
+		return nil, err
+	}
+
+	return &stats, nil
+}
+
+// Find out which versions of the messages the server understands.  Servers from before versions
+// were added don't know about Hello, so they are reported as version 0.
+func (self Client) Hello() (Hello, error) {
+	var server Hello
+	_, err := self.call("protocol.Hello", Hello{Version: ProtocolVersion, MinVersion: MinProtocolVersion}, &server)
+	if responseErr, ok := err.(ResponseError); ok && responseErr.Status == UnknownRequest {
+		return Hello{}, nil
+	}
+
+	return server, err
+}
+
+func (self Client) GetIncomingRule(dataset string) (*Rule, error) {
+	return self.GetRule(dataset, true)
+}
+
+func (self Client) GetOutgoingRule(dataset string) (*Rule, error) {
+	return self.GetRule(dataset, false)
+}
+
+// Get the best rule found so far for a dataset and direction, with its score and counts.  Returns
+// nil if there isn't a rule yet.
+func (self Client) GetRule(dataset string, incoming bool) (*Rule, error) {
+	var rule Rule
+	found, err := self.call("protocol.RuleRequest", RuleRequest{Dataset: dataset, Incoming: incoming}, &rule)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return &rule, nil
+}
+
+// Get the best rules found so far for a dataset and direction, best first.  Returns no rules if
+// the server doesn't know about the dataset yet.
+func (self Client) GetTopRules(dataset string, incoming bool) ([]Rule, error) {
+	var top TopRules
+	_, err := self.call("protocol.TopRulesRequest", TopRulesRequest{Dataset: dataset, Incoming: incoming}, &top)
+	return top.Rules, err
+}
+
+// Get the latest rule the rule service has published for every dataset and direction.
+func (self Client) GetSnapshot() ([]Rule, error) {
+	var snapshot RuleSnapshot
+	_, err := self.call("protocol.SnapshotRequest", SnapshotRequest{}, &snapshot)
+	return snapshot.Rules, err
+}
+
+// Send a request and decode the value of the Response into result, which is a pointer.  Returns
+// false if the Response doesn't have a value.
+func (self Client) call(name string, request interface{}, result interface{}) (bool, error) {
+	data, err := EncodeRequest(name, request, self.token)
+	if err != nil {
+		return false, err
+	}
+
+	reply, err := self.request(data)
+	if err != nil {
+		return false, err
+	}
+
+	response, err := DecodeResponse(reply)
+	if err != nil {
+		return false, err
+	}
+
+	if response.Value == nil {
+		return false, nil
+	}
+
+	err = decodeValue(reply, &Response{Value: result})
 	if err != nil {
-		return nil
+		return false, fmt.Errorf("malformed response to %s: %s", name, err)
 	}
 
-	return self.request(b)
+	return true, nil
 }
 
-func (self Client) request(data []byte) []byte {
+func (self Client) request(data []byte) ([]byte, error) {
 	var err error
 	var msg []byte
 
-	// Note that the length of data is not necessarily equal to the number of bytes in the packet
-	// payload since data is the encoded version of a struct containing the packet payload.
-	fmt.Printf("AdversaryLab client sending %d\n", len(data))
 	if err = self.sock.Send(data); err != nil {
-		die("can't send message on push socket: %s", err.Error())
+		return nil, fmt.Errorf("can't send message on req socket: %s", err.Error())
 	}
 	if msg, err = self.sock.Recv(); err != nil {
-		die("can't receive date: %s", err.Error())
+		return nil, fmt.Errorf("can't receive reply: %s", err.Error())
 	}
-	fmt.Printf("AdversaryLab client received response %s\n", string(msg))
 
-	return msg
+	return msg, nil
 }
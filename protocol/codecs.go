@@ -1,6 +1,8 @@
 package protocol
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"reflect"
 
@@ -17,13 +19,17 @@ type Named interface {
 }
 
 type NamedType struct {
-	Name  string
-	Value interface{}
+	Name    string
+	Value   interface{}
+	Version int	// version of the message, ProtocolVersion for requests and the request's version for replies
+	Token   string	// shared token that identifies the client to servers with an ACL, "" for none
 }
 
 type RawNamedType struct {
-	Name  string
-	Value interface{}
+	Name    string
+	Value   interface{}
+	Version int
+	Token   string
 }
 
 type NamedTypeExt struct{}
@@ -34,16 +40,114 @@ func NamedTypeHandle() codec.Handle {
 	namedType := reflect.TypeOf(NamedType{})
 	var namedTypeExt NamedTypeExt
 
-	h.SetExt(namedType, 78, namedTypeExt)
+	h.SetInterfaceExt(namedType, 78, namedTypeExt)
 
 	return h
 }
 
-func (x NamedTypeExt) WriteExt(interface{}) []byte {
-	panic("unsupported")
+// Encode a value wrapped in a NamedType with the given name, such as "protocol.Rule".
+func EncodeNamedType(name string, value interface{}) ([]byte, error) {
+	return EncodeRequest(name, value, "")
 }
-func (x NamedTypeExt) ReadExt(interface{}, []byte) {
-	panic("unsupported")
+
+// Encode a request wrapped in a NamedType along with the client's token, for servers that only
+// let some clients read or train on some datasets.
+func EncodeRequest(name string, value interface{}, token string) ([]byte, error) {
+	return encodeVersion(name, value, token, ProtocolVersion, ProtocolVersion)
+}
+
+// Encode a message for clients that only understand version, such as the rules that are published
+// to every subscriber.  The message is translated down from ProtocolVersion if it has changed since.
+func EncodeVersion(name string, value interface{}, token string, version int) ([]byte, error) {
+	return encodeVersion(name, value, token, ProtocolVersion, version)
+}
+
+// Encode a message that is in version from as version to.
+func encodeVersion(name string, value interface{}, token string, from int, to int) ([]byte, error) {
+	name, value, err := downgrade(name, value, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	var buff = new(bytes.Buffer)
+	var bw = bufio.NewWriter(buff)
+	var enc = codec.NewEncoder(bw, NamedTypeHandle())
+	err = enc.Encode(NamedType{Name: name, Value: value, Version: to, Token: token})
+	if err != nil {
+		return nil, err
+	}
+
+	bw.Flush()
+
+	return buff.Bytes(), nil
+}
+
+// Decode a NamedType.  The Value is left as it was decoded, usually a map[interface{}]interface{}.
+func DecodeNamedType(data []byte) (value NamedType, err error) {
+	// Malformed messages come from the network, so they shouldn't be able to take a server down.
+	defer func() {
+		if r := recover(); r != nil {
+			value, err = NamedType{}, fmt.Errorf("malformed message: %v", r)
+		}
+	}()
+
+	var dec = codec.NewDecoderBytes(data, NamedTypeHandle())
+	err = dec.Decode(&value)
+	return value, err
+}
+
+// Encode a Response in ProtocolVersion.  If it can't be encoded, an InternalError Response is
+// sent instead.  Servers answer requests with Request.Reply, so that older clients can read it.
+func EncodeResponse(response Response) []byte {
+	return EncodeResponseVersion(response, ProtocolVersion)
+}
+
+// Encode a Response for a client that sent its request in version.  The Response and its Value
+// are translated down to the nearest version this package can send.
+func EncodeResponseVersion(response Response, version int) []byte {
+	return encodeResponse(response, ProtocolVersion, ReplyVersion(version))
+}
+
+// Encode a Response that is in version from as version to.
+func encodeResponse(response Response, from int, to int) []byte {
+	var err error
+	if name := messageName(response.Value); name != "" {
+		_, response.Value, err = downgrade(name, response.Value, from, to)
+	}
+
+	var data []byte
+	if err == nil {
+		data, err = encodeVersion("protocol.Response", response, "", from, to)
+	}
+	if err != nil {
+		data, _ = encodeVersion("protocol.Response", ErrorResponse(InternalError, "Error encoding response: "+err.Error()), "", from, to)
+	}
+
+	return data
+}
+
+// Decode a Response, returning a ResponseError if the request failed.  Servers from before
+// Responses were added answer everything with "success".
+func DecodeResponse(data []byte) (Response, error) {
+	if string(data) == "success" {
+		return NewResponse(nil), nil
+	}
+
+	name, value, err := DecodeMessage(data)
+	if err != nil {
+		return Response{}, err
+	}
+
+	response, ok := value.(Response)
+	if !ok {
+		return Response{}, fmt.Errorf("Expected a protocol.Response, got %s", name)
+	}
+
+	if response.Status != Success {
+		return response, ResponseError{Status: response.Status, Message: response.Error}
+	}
+
+	return response, nil
 }
 
 // ConvertExt converts a value into a simpler interface for easy encoding e.g. convert time.Time to int64.
@@ -53,7 +157,12 @@ func (x NamedTypeExt) ConvertExt(v interface{}) interface{} {
 	switch v.(type) {
 	case NamedType:
 		var nt = v.(NamedType)
-		return RawNamedType{Name: nt.Name, Value: nt.Value}
+		return RawNamedType{Name: nt.Name, Value: nt.Value, Version: nt.Version, Token: nt.Token}
+	case *NamedType:
+		// Since 1.1 the codec passes a pointer to the value being encoded, so without this case
+		// every NamedType panics.
+		var nt = v.(*NamedType)
+		return RawNamedType{Name: nt.Name, Value: nt.Value, Version: nt.Version, Token: nt.Token}
 	// case *Named:
 	//   var named Named = *v
 	//   return NamedType{Name: named.Name(), Value: named}
@@ -64,16 +173,33 @@ func (x NamedTypeExt) ConvertExt(v interface{}) interface{} {
 
 // UpdateExt updates a value from a simpler interface for easy decoding e.g. convert int64 to time.Time.
 // From NamedType to NamedType
+// Anything that isn't a NamedType is decoded as a NamedType without a name, which DecodeMessage
+// reports as an unknown message rather than panicking.
 func (x NamedTypeExt) UpdateExt(dest interface{}, v interface{}) {
 	//	fmt.Println("Updating Ext")
 	ret := dest.(*NamedType)
 	switch v.(type) {
 	case map[interface{}]interface{}:
 		rnt := v.(map[interface{}]interface{})
-		nt := NamedType{Name: rnt["Name"].(string), Value: rnt["Value"]}
+		name, _ := rnt["Name"].(string)
+		token, _ := rnt["Token"].(string)
+		nt := NamedType{Name: name, Value: rnt["Value"], Token: token}
+
+		// Messages from before versions were added don't have one, so they are version 0.
+		switch version := rnt["Version"].(type) {
+		case uint64:
+			nt.Version = int(version)
+		case int64:
+			nt.Version = int(version)
+		}
 
 		*ret = nt
+	case RawNamedType:
+		// Since 1.1 the codec decodes into the type returned by ConvertExt instead of a map, so
+		// without this case every NamedType is decoded without a name.
+		rnt := v.(RawNamedType)
+		*ret = NamedType{Name: rnt.Name, Value: rnt.Value, Version: rnt.Version, Token: rnt.Token}
 	default:
-		panic(fmt.Sprintf("unsupported format for named type update: expecting RawNamedType; got %T", v))
+		*ret = NamedType{}
 	}
 }
@@ -0,0 +1,150 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-mangos/mangos"
+	"github.com/go-mangos/mangos/protocol/pull"
+	"github.com/go-mangos/mangos/protocol/push"
+)
+
+// The ingestion socket takes training packets without replying to them, so many capture agents
+// can stream packets into the lab without waiting for each one to be stored.  Each side has a
+// bounded queue, and so does each dataset in the lab.  Packets are never dropped by the lab.  When
+// one dataset falls behind, the other datasets keep training on what they have queued, and once
+// that dataset's queue is full the lab stops reading.  The lab's queue fills up, then the sender's,
+// and then sending fails with ErrBusy until the lab catches up.
+
+// Number of messages each side of the ingestion socket queues.
+const IngestQueueLength = 1024
+
+// How long a send waits for room in the queue before failing with ErrBusy.  It is short so that a
+// capture agent can drop or hold on to packets instead of stalling its capture.
+const IngestTimeout = 100 * time.Millisecond
+
+// Returned when the lab isn't taking training packets as fast as they are sent.  The packet
+// wasn't sent, so it can be sent again later.
+var ErrBusy = errors.New("server is busy")
+
+// Client for streaming training packets to the ingestion socket on tcp://localhost:4571.
+type Ingester struct {
+	sock  mangos.Socket
+	token string // Options.Token, sent with every message
+}
+
+// Server side of the ingestion socket.
+type IngestServer struct {
+	sock mangos.Socket
+}
+
+// Connect to the ingestion socket.  A send waits up to IngestTimeout for room in the queue before
+// failing with ErrBusy, or up to Options.Timeout if that is shorter.
+func DialIngest(url string, options Options) (Ingester, error) {
+	var sock mangos.Socket
+	var err error
+
+	if sock, err = push.NewSocket(); err != nil {
+		return Ingester{}, err
+	}
+
+	timeout := IngestTimeout
+	if options.Timeout > 0 && options.Timeout < timeout {
+		timeout = options.Timeout
+	}
+
+	err = sock.SetOption(mangos.OptionWriteQLen, IngestQueueLength)
+	if err == nil {
+		err = sock.SetOption(mangos.OptionSendDeadline, timeout)
+	}
+	if err == nil {
+		err = dialSocket(sock, url, options)
+	}
+	if err != nil {
+		sock.Close()
+		return Ingester{}, err
+	}
+
+	return Ingester{
+		sock:  sock,
+		token: options.Token,
+	}, nil
+}
+
+// Queue a training packet to be sent.  Unlike Client.SendTrainPacket, this doesn't wait for the
+// packet to be stored, and there is no index or error if it can't be.
+func (self Ingester) SendTrainPacket(packet TrainPacket) error {
+	return self.send("protocol.TrainPacket", packet)
+}
+
+// Queue many training packets to be sent in one message.
+func (self Ingester) SendTrainPackets(packets []TrainPacket) error {
+	return self.send("protocol.TrainBatch", TrainBatch{Packets: packets})
+}
+
+func (self Ingester) send(name string, value interface{}) error {
+	data, err := EncodeRequest(name, value, self.token)
+	if err != nil {
+		return err
+	}
+
+	err = self.sock.Send(data)
+	if err == mangos.ErrSendTimeout {
+		return ErrBusy
+	} else if err != nil {
+		return fmt.Errorf("can't send message on push socket: %s", err.Error())
+	}
+
+	return nil
+}
+
+func (self Ingester) Close() error {
+	return self.sock.Close()
+}
+
+// Set up the ingestion socket on tcp://localhost:4571.
+func NewIngestServer(url string, options Options) (IngestServer, error) {
+	var sock mangos.Socket
+	var err error
+
+	if sock, err = pull.NewSocket(); err != nil {
+		return IngestServer{}, err
+	}
+
+	err = sock.SetOption(mangos.OptionReadQLen, IngestQueueLength)
+	if err == nil {
+		err = sock.SetOption(mangos.OptionMaxRecvSize, MaxRequestSize)
+	}
+	if err == nil {
+		err = listenSocket(sock, url, options)
+	}
+	if err != nil {
+		sock.Close()
+		return IngestServer{}, err
+	}
+
+	return IngestServer{
+		sock: sock,
+	}, nil
+}
+
+// Pass each message received on the ingestion socket to handle, until the socket is closed.
+// While handle is blocked, messages wait in the queue.
+func (self IngestServer) Pump(handle func([]byte)) {
+	for {
+		msg, err := self.sock.Recv()
+		if err == mangos.ErrClosed {
+			return
+		} else if err != nil {
+			fmt.Println("Error reading ingestion socket", err)
+			continue
+		}
+
+		handle(msg)
+	}
+}
+
+func (self IngestServer) Close() error {
+	return self.sock.Close()
+}
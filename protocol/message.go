@@ -1,16 +1,59 @@
 package protocol
 
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
 type TrainPacket struct {
 	Dataset    string
 	AllowBlock bool
 	Incoming   bool
 	Payload    []byte
+	Timestamp  int64	// capture time in Unix nanoseconds, 0 to use the time the server received it
+	Connection uint64	// id of the capture/connection the payload came from, 0 if unknown
+}
+
+// Many training packets sent in one request, which can be for different datasets and directions.
+type TrainBatch struct {
+	Packets []TrainPacket
 }
 
+// A packet of held-out traffic to check the current rule against.  It isn't stored or trained on.
 type TestPacket struct {
+	Dataset    string
+	AllowBlock bool	// true if the packet should be allowed, to check the rule's decision against
+	Incoming   bool
+	Payload    []byte
+}
+
+// What the current rule decided for a TestPacket.
+type TestResult struct {
+	Dataset  string
+	Incoming bool
+	Tested   bool	// false if there wasn't a rule to test the packet with yet
+	Blocked  bool	// true if the rule blocked the packet
+	Correct  bool	// true if the rule's decision matched the packet's label
+}
+
+// Asks the test service for the counts of the decisions made for a dataset and direction.
+type TestStatsRequest struct {
 	Dataset  string
 	Incoming bool
-	Payload  []byte
+}
+
+// Counts of the decisions the rules made for the test packets of a dataset and direction, since
+// the server was started.  Blocking is the positive decision, so a true positive is a blocked
+// packet that was labeled block.
+type TestStats struct {
+	Dataset        string
+	Incoming       bool
+	TruePositives  int64	// blocked packets that were labeled block
+	FalsePositives int64	// blocked packets that were labeled allow
+	TrueNegatives  int64	// allowed packets that were labeled allow
+	FalseNegatives int64	// allowed packets that were labeled block
+	Untested       int64	// packets that arrived before there was a rule
 }
 
 type RuleRequest struct {
@@ -18,30 +61,158 @@ type RuleRequest struct {
 	Incoming bool
 }
 
+// Asks for the best rules found so far for a dataset and direction, best first.
+type TopRulesRequest struct {
+	Dataset  string
+	Incoming bool
+}
+
+type TopRules struct {
+	Dataset  string
+	Incoming bool
+	Rules    []Rule	// best first, empty if there are no rules yet
+}
+
+// Asks the rule service for the latest rule it has published for every dataset and direction.
+type SnapshotRequest struct {
+}
+
+type RuleSnapshot struct {
+	Rules []Rule	// one for each dataset and direction that has a rule
+}
+
 type Rule struct {
 	Dataset       string	// i.e. "dataset1"
 	RequireForbid bool	// true if rule should be used for allowing.
 	Incoming      bool	// whether or not this rule is for incoming or outgoing traffic.
 	Sequence      []byte	// offset (2 bytes) and rest of byte subsequence concatenated
+	AllowPrefix   []byte	// most likely prefix of allowed payloads, from the allow bytemap
+	BlockPrefix   []byte	// most likely prefix of blocked payloads, from the block bytemap
+	Score         float64	// how well the sequence separates allowed from blocked traffic, higher is better
+	AllowCount    int64	// # of allowed packets that matched
+	AllowTotal    int64	// # of allowed packets seen
+	BlockCount    int64	// # of blocked packets that matched
+	BlockTotal    int64	// # of blocked packets seen
 }
 
 type ResultStatus int
 
-// The structs are decoded as interfaces, so need to convert them back into structs.
-func TrainPacketFromMap(data map[interface{}]interface{}) TrainPacket {
-	packet := TrainPacket{}
-	packet.Dataset = data["Dataset"].(string)
-	packet.AllowBlock = data["AllowBlock"].(bool)
-	packet.Incoming = data["Incoming"].(bool)
-	packet.Payload = data["Payload"].([]byte)
-	return packet
-}
-
-func RuleFromMap(data map[interface{}]interface{}) Rule {
-	rule := Rule{}
-	rule.Dataset = data["Dataset"].(string)
-	rule.RequireForbid = data["RequireForbid"].(bool)
-	rule.Incoming = data["Incoming"].(bool)
-	rule.Sequence = data["Sequence"].([]byte)
-	return rule
+const (
+	Success        ResultStatus = iota	// the request was handled
+	DecodeFailed			// the request couldn't be decoded
+	UnknownRequest			// the service doesn't handle this type of request
+	InvalidRequest			// the request is missing something, such as a payload
+	DatasetFailed			// the dataset couldn't be opened
+	StoreFailed			// the training packet couldn't be stored
+	InternalError			// the result couldn't be encoded
+	Busy				// the dataset's queue is full, so the packet wasn't stored and can be sent again later
+	UnsupportedVersion		// the request was encoded with a version of the messages the server doesn't support
+	Forbidden			// the request's token isn't allowed to read or train on the dataset
+)
+
+// Every reply from the training service and the snapshot socket is a Response, so clients
+// can tell when a request failed and why.
+type Response struct {
+	Status ResultStatus
+	Error  string		// why the request failed, "" on success
+	Index  int64		// index the training packet was stored at, -1 for other requests
+	Value  interface{}	// the result, such as a Rule, TopRules or the indices of a TrainBatch, nil if there isn't one
+}
+
+// Returned by the Client when the server answers with a status other than Success.
+type ResponseError struct {
+	Status  ResultStatus
+	Message string
+}
+
+func (self ResultStatus) String() string {
+	switch self {
+	case Success:
+		return "success"
+	case DecodeFailed:
+		return "decode failed"
+	case UnknownRequest:
+		return "unknown request"
+	case InvalidRequest:
+		return "invalid request"
+	case DatasetFailed:
+		return "dataset failed"
+	case StoreFailed:
+		return "store failed"
+	case InternalError:
+		return "internal error"
+	case Busy:
+		return "busy"
+	case UnsupportedVersion:
+		return "unsupported version"
+	case Forbidden:
+		return "forbidden"
+	default:
+		return fmt.Sprintf("status %d", int(self))
+	}
+}
+
+func (self ResponseError) Error() string {
+	return self.Status.String() + ": " + self.Message
+}
+
+// A successful Response with a result.
+func NewResponse(value interface{}) Response {
+	return Response{Status: Success, Index: -1, Value: value}
+}
+
+// A failed Response.
+func ErrorResponse(status ResultStatus, message string) Response {
+	return Response{Status: status, Error: message, Index: -1}
+}
+
+// The offset the rule's subsequence starts at, from the first two bytes of the Sequence.
+func (self Rule) Offset() int {
+	if len(self.Sequence) < 2 {
+		return 0
+	}
+
+	return int(int16(binary.LittleEndian.Uint16(self.Sequence[0:2])))
+}
+
+// The bytes the rule looks for at its offset, without the offset.
+func (self Rule) Subsequence() []byte {
+	if len(self.Sequence) < 2 {
+		return nil
+	}
+
+	return self.Sequence[2:]
+}
+
+// Returns true if the payload has the rule's subsequence at the rule's offset.
+func (self Rule) Matches(payload []byte) bool {
+	subsequence := self.Subsequence()
+	offset := self.Offset()
+	if len(subsequence) == 0 || offset < 0 || offset+len(subsequence) > len(payload) {
+		return false
+	}
+
+	return bytes.Equal(payload[offset:offset+len(subsequence)], subsequence)
+}
+
+// Returns true if an adversary using the rule would block the payload.  A block rule blocks the
+// payloads that match it and an allow rule blocks the ones that don't.
+func (self Rule) Blocks(payload []byte) bool {
+	return self.Matches(payload) != self.RequireForbid
+}
+
+// Count a decision for a test packet.
+func (self *TestStats) Add(result TestResult, allowBlock bool) {
+	switch {
+	case !result.Tested:
+		self.Untested++
+	case result.Blocked && !allowBlock:
+		self.TruePositives++
+	case result.Blocked:
+		self.FalsePositives++
+	case allowBlock:
+		self.TrueNegatives++
+	default:
+		self.FalseNegatives++
+	}
 }
@@ -0,0 +1,83 @@
+package protocol
+
+import (
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"github.com/go-mangos/mangos"
+	"github.com/go-mangos/mangos/transport/tcp"
+	"github.com/go-mangos/mangos/transport/tlstcp"
+)
+
+// Options for connecting to the services, and for the services' sockets.  TLS is used for
+// "tls+tcp://" addresses, i.e. "tls+tcp://lab.example.com:4567".
+type Options struct {
+	Timeout          time.Duration // how long connecting, sending a request or waiting for its reply can take, 0 for no limit
+	ReconnectTime    time.Duration // how long to wait before redialing a lost connection
+	MaxReconnectTime time.Duration // the wait doubles after each failed redial, up to this
+	TLSConfig        *tls.Config   // certificates for "tls+tcp://" addresses; for servers, set ClientCAs and ClientAuth to require client certificates
+	Token            string        // sent with every request, for servers that only let some clients train on some datasets
+	OnError          func(error)   // called with errors that can't be returned, such as a rule that can't be decoded; nil to ignore them
+}
+
+// Used by Connect and the PubsubConnect functions.
+func DefaultOptions() Options {
+	return Options{Timeout: 30 * time.Second, ReconnectTime: 100 * time.Millisecond, MaxReconnectTime: 30 * time.Second}
+}
+
+// Dial the socket, giving up after the timeout.  Once it has connected, the socket redials on its
+// own with backoff if the connection is lost.
+func dialSocket(sock mangos.Socket, url string, options Options) error {
+	if err := addTransports(sock, options); err != nil {
+		return err
+	}
+
+	if options.ReconnectTime > 0 {
+		if err := sock.SetOption(mangos.OptionReconnectTime, options.ReconnectTime); err != nil {
+			return err
+		}
+	}
+	if options.MaxReconnectTime > 0 {
+		if err := sock.SetOption(mangos.OptionMaxReconnectTime, options.MaxReconnectTime); err != nil {
+			return err
+		}
+	}
+
+	if options.Timeout == 0 {
+		return sock.Dial(url)
+	}
+
+	// The caller closes the socket if this fails, which stops the dial.
+	result := make(chan error, 1)
+	go func() {
+		result <- sock.Dial(url)
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(options.Timeout):
+		return fmt.Errorf("timed out connecting to %s", url)
+	}
+}
+
+// Listen on the socket, with TLS for "tls+tcp://" addresses.
+func listenSocket(sock mangos.Socket, url string, options Options) error {
+	if err := addTransports(sock, options); err != nil {
+		return err
+	}
+
+	return sock.Listen(url)
+}
+
+func addTransports(sock mangos.Socket, options Options) error {
+	sock.AddTransport(tcp.NewTransport())
+	sock.AddTransport(tlstcp.NewTransport())
+
+	if options.TLSConfig != nil {
+		return sock.SetOption(mangos.OptionTLSConfig, options.TLSConfig)
+	}
+
+	return nil
+}
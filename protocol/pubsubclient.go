@@ -1,80 +1,234 @@
 package protocol
 
 import (
+	"bytes"
 	"fmt"
-
-	"github.com/ugorji/go/codec"
+	"sync"
 
 	"github.com/go-mangos/mangos"
 	"github.com/go-mangos/mangos/protocol/sub"
-	"github.com/go-mangos/mangos/transport/tcp"
 )
 
 // Client for receiving best rule updates
 type PubsubClient struct {
 	sock  mangos.Socket	// Client-side socket
-	Rules chan Rule		// Channel for decoded rules
+	Rules chan Rule		// Channel for decoded rules, closed when the client is closed
+	done  chan struct{}	// closed by Close so that the pump stops even if nobody reads Rules
+	once  *sync.Once
 }
 
 // Connect to server on tcp://localhost:4568.
 func PubsubConnect(url string) PubsubClient {
-	var sock mangos.Socket
-	var err error
+	return PubsubConnectDatasets(url, nil)
+}
 
-	if sock, err = sub.NewSocket(); err != nil {
-		die("can't get new req socket: %s", err.Error())
+// Connect to the server on tcp://localhost:4568 and only receive the rules for some datasets,
+// i.e. []string{"dataset1", "dataset2"}.  Rules for other datasets are filtered out by the
+// subscription, so they aren't decoded.
+func PubsubConnectDatasets(url string, datasets []string) PubsubClient {
+	client, err := PubsubDial(url, datasets, DefaultOptions())
+	if err != nil {
+		die("can't dial on sub socket: %s", err.Error())
+	}
+
+	return client
+}
+
+// Connect to the server on tcp://localhost:4568 and get the current rules from its snapshot socket
+// on tcp://localhost:4570.  The current rule for every dataset and direction comes out of the Rules
+// channel first, followed by the updates.  Updates published while the snapshot is being fetched
+// are held by the subscription until the snapshot has been sent, so none are missed.
+// If any datasets are given, only their rules are received.
+func PubsubConnectWithSnapshot(url string, snapshotURL string, datasets ...string) PubsubClient {
+	client, err := PubsubDialWithSnapshot(url, snapshotURL, datasets, DefaultOptions())
+	if err != nil {
+		die("can't dial on sub socket: %s", err.Error())
 	}
 
-	sock.AddTransport(tcp.NewTransport())
+	return client
+}
+
+// Like PubsubConnectDatasets, but returns an error instead of exiting if the server can't be
+// reached.  If the connection is lost later, it is redialed in the background.
+func PubsubDial(url string, datasets []string, options Options) (PubsubClient, error) {
+	sock, err := subscribe(url, datasets, options)
+	if err != nil {
+		return PubsubClient{}, err
+	}
+
+	return startPump(sock, nil, options.OnError), nil
+}
+
+// Like PubsubConnectWithSnapshot, but returns an error instead of exiting if either socket can't
+// be reached or the snapshot can't be fetched.
+func PubsubDialWithSnapshot(url string, snapshotURL string, datasets []string, options Options) (PubsubClient, error) {
+	sock, err := subscribe(url, datasets, options)
+	if err != nil {
+		return PubsubClient{}, err
+	}
 
-	if err = sock.Dial(url); err != nil {
-		die("can't dial on req socket: %s", err.Error())
+	snapshot, err := Dial(snapshotURL, options)
+	if err != nil {
+		sock.Close()
+		return PubsubClient{}, err
 	}
 
-	err = sock.SetOption(mangos.OptionSubscribe, []byte(""))
+	current, err := snapshot.GetSnapshot()
+	snapshot.Close()
 	if err != nil {
-		die("cannot subscribe: %s", err.Error())
+		sock.Close()
+		return PubsubClient{}, err
 	}
 
-	rules := make(chan Rule)
+	var first []Rule
+	for _, rule := range current {
+		if len(datasets) == 0 || containsString(datasets, rule.Dataset) {
+			first = append(first, rule)
+		}
+	}
 
-	go pump(sock, rules)
+	return startPump(sock, first, options.OnError), nil
+}
 
-	return PubsubClient{
+// Start pumping rules from the socket, after sending the rules in first.  Errors go to onError,
+// if there is one.
+func startPump(sock mangos.Socket, first []Rule, onError func(error)) PubsubClient {
+	client := PubsubClient{
 		sock:  sock,
-		Rules: rules,
+		Rules: make(chan Rule),
+		done:  make(chan struct{}),
+		once:  new(sync.Once),
 	}
+
+	go pump(sock, first, client.Rules, client.done, onError)
+
+	return client
+}
+
+// Stop receiving rules.  The Rules channel is closed once the subscription has stopped.
+func (self PubsubClient) Close() error {
+	self.once.Do(func() {
+		close(self.done)
+	})
+
+	return self.sock.Close()
 }
 
-// Goroutine that reads and decodes rules from the socket.  Pushes them out onto the Rule channel.
-func pump(sock mangos.Socket, rules chan Rule) {
+// Create a subscriber socket that receives the rules for the datasets, or every rule if there
+// aren't any datasets.
+func subscribe(url string, datasets []string, options Options) (mangos.Socket, error) {
+	var sock mangos.Socket
+	var err error
+
+	if sock, err = sub.NewSocket(); err != nil {
+		return nil, err
+	}
+
+	if len(datasets) == 0 {
+		err = sock.SetOption(mangos.OptionSubscribe, []byte(""))
+	}
+
+	for _, dataset := range datasets {
+		for _, incoming := range []bool{true, false} {
+			if err == nil {
+				err = sock.SetOption(mangos.OptionSubscribe, RuleTopic(dataset, incoming))
+			}
+		}
+	}
+
+	if err == nil {
+		err = dialSocket(sock, url, options)
+	}
+
+	if err != nil {
+		sock.Close()
+		return nil, err
+	}
+
+	return sock, nil
+}
+
+// Goroutine that reads and decodes rules from the socket.  Pushes them out onto the Rule channel,
+// which is closed when the socket is.  Stops when done is closed, even while waiting for a rule
+// to be read.  Messages that can't be decoded are skipped and reported to onError.
+func pump(sock mangos.Socket, first []Rule, rules chan Rule, done chan struct{}, onError func(error)) {
 	var err error
 	var msg []byte
 
+	report := func(err error) {
+		if onError != nil {
+			onError(err)
+		}
+	}
+
+	defer close(rules)
+
+	for _, rule := range first {
+		select {
+		case rules <- rule:
+		case <-done:
+			return
+		}
+	}
+
 	for {
 		msg, err = sock.Recv()
-		if err != nil {
-			fmt.Println("Error reading subscription", err)
+		if err == mangos.ErrClosed {
+			return
+		} else if err != nil {
+			report(fmt.Errorf("error reading subscription: %s", err))
 			return
 		}
 
-		var value = NamedType{}
-		var h = NamedTypeHandle()
-		var dec = codec.NewDecoderBytes(msg, h)
-		var err = dec.Decode(&value)
+		_, body := splitTopic(msg)
+
+		name, value, err := DecodeMessage(body)
 		if err != nil {
-			fmt.Println("Failed to decode")
-			fmt.Println(err.Error())
+			report(fmt.Errorf("can't decode rule: %s", err))
 			continue
 		}
 
-		switch value.Name {
-		case "protocol.Rule":
-			rule := RuleFromMap(value.Value.(map[interface{}]interface{}))
-			rules <- rule
+		switch value := value.(type) {
+		case Rule:
+			select {
+			case rules <- value:
+			case <-done:
+				return
+			}
 		default:
-			fmt.Println("Unknown request type")
-			fmt.Println(value)
+			report(fmt.Errorf("expected a protocol.Rule, got %s", name))
 		}
 	}
 }
+
+// Topic that rules for a dataset and direction are published under, i.e. "dataset1-incoming\x00".
+// Subscribers filter on it, and it ends in a 0 byte so that "dataset1" doesn't match "dataset10".
+func RuleTopic(dataset string, incoming bool) []byte {
+	if incoming {
+		return []byte(dataset + "-incoming\x00")
+	}
+
+	return []byte(dataset + "-outgoing\x00")
+}
+
+// Split a published message into its topic and the encoded rule.  Servers from before topics
+// were added send the encoded rule on its own, which starts with the NamedType tag (0xd8 0x4e)
+// rather than a dataset name.
+func splitTopic(msg []byte) (topic []byte, body []byte) {
+	end := bytes.IndexByte(msg, 0)
+	if end < 0 || (len(msg) > 0 && msg[0] == 0xd8) {
+		return nil, msg
+	}
+
+	return msg[:end+1], msg[end+1:]
+}
+
+func containsString(values []string, value string) bool {
+	for _, current := range values {
+		if current == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -3,7 +3,6 @@ package protocol
 import (
 	"github.com/go-mangos/mangos"
 	"github.com/go-mangos/mangos/protocol/pub"
-	"github.com/go-mangos/mangos/transport/tcp"
 )
 
 type PubsubSource chan []byte
@@ -14,23 +13,38 @@ type PubsubServer struct {
 }
 
 // Set up pub/sub server that will send out rule updates from the PubsubSource byte channel.
-func PubsubListen(url string, source PubsubSource) PubsubServer {
+// Exits if the socket can't be set up.
+func PubsubListen(url string, source PubsubSource, options Options) PubsubServer {
+	server, err := NewPubsubServer(url, source, options)
+	if err != nil {
+		die("can't listen on pub socket: %s", err.Error())
+	}
+
+	return server
+}
+
+// Like PubsubListen, but returns an error instead of exiting.
+func NewPubsubServer(url string, source PubsubSource, options Options) (PubsubServer, error) {
 	var sock mangos.Socket
 	var err error
 
 	if sock, err = pub.NewSocket(); err != nil {
-		die("can't get new rep socket: %s", err)
+		return PubsubServer{}, err
 	}
 
-	sock.AddTransport(tcp.NewTransport())
-	if err = sock.Listen(url); err != nil {
-		die("can't listen on rep socket: %s", err.Error())
+	if err = listenSocket(sock, url, options); err != nil {
+		sock.Close()
+		return PubsubServer{}, err
 	}
 
 	return PubsubServer{
 		sock:   sock,
 		source: source,
-	}
+	}, nil
+}
+
+func (self PubsubServer) Close() error {
+	return self.sock.Close()
 }
 
 // Continuously reads from the PubsubSource and sends the data to the pub socket to send.
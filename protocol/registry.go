@@ -0,0 +1,176 @@
+package protocol
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/ugorji/go/codec"
+)
+
+// Every kind of message that is sent as a NamedType, by the name it is sent with.  DecodeMessage
+// decodes the Value of a NamedType into the struct registered for its name.  To add a new kind of
+// message, define its struct and add it here, or call RegisterMessage from an init function.
+var messages = map[string]reflect.Type{}
+
+func init() {
+	RegisterMessage("protocol.TrainPacket", TrainPacket{})
+	RegisterMessage("protocol.TrainBatch", TrainBatch{})
+	RegisterMessage("protocol.TestPacket", TestPacket{})
+	RegisterMessage("protocol.TestResult", TestResult{})
+	RegisterMessage("protocol.TestStatsRequest", TestStatsRequest{})
+	RegisterMessage("protocol.TestStats", TestStats{})
+	RegisterMessage("protocol.RuleRequest", RuleRequest{})
+	RegisterMessage("protocol.TopRulesRequest", TopRulesRequest{})
+	RegisterMessage("protocol.TopRules", TopRules{})
+	RegisterMessage("protocol.SnapshotRequest", SnapshotRequest{})
+	RegisterMessage("protocol.RuleSnapshot", RuleSnapshot{})
+	RegisterMessage("protocol.Rule", Rule{})
+	RegisterMessage("protocol.Response", Response{})
+	RegisterMessage("protocol.Hello", Hello{})
+}
+
+// Returned by DecodeMessage for a NamedType with a name that isn't registered.
+type UnknownMessageError struct {
+	Name string
+}
+
+func (self UnknownMessageError) Error() string {
+	return "unknown message type " + self.Name
+}
+
+// Register the struct that messages with the name are decoded into, i.e.
+// RegisterMessage("protocol.TrainPacket", TrainPacket{}).  Not safe to call while messages are
+// being decoded, so register messages before starting any clients or services.
+func RegisterMessage(name string, value interface{}) {
+	messages[name] = reflect.TypeOf(value)
+}
+
+// The name that a value's type is registered under, or "" if it isn't registered.
+func messageName(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+
+	valueType := reflect.TypeOf(value)
+	if valueType.Kind() == reflect.Ptr {
+		valueType = valueType.Elem()
+	}
+
+	for name, messageType := range messages {
+		if messageType == valueType {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// A message decoded by DecodeRequest, with the token and version the client sent it with.
+type Request struct {
+	Name    string
+	Value   interface{} // the struct registered for the name
+	Token   string      // "" if the client didn't send one
+	Version int         // version the client sent it in, 0 if it couldn't be decoded at all
+}
+
+// Encode the Response to the request in the version the request was sent in, or the nearest one
+// this package can send, so that older clients can read it.
+func (self Request) Reply(response Response) []byte {
+	return EncodeResponseVersion(response, self.Version)
+}
+
+// Decode a NamedType and its Value, which is returned as the struct registered for its name, not
+// a pointer to it.  Fields that are missing from the message are left as zero values, which is
+// how older clients and servers are handled.  Messages from older versions are translated to the
+// current version first.  Messages from newer versions are decoded as they are, with the fields
+// this version doesn't know about ignored, since newer servers translate what they send down to
+// the version the client asked in where they have to.  Returns an error instead of panicking if
+// the message is malformed, an UnknownMessageError if the name isn't registered and a
+// VersionError if the message is too old or can't be translated.
+func DecodeMessage(data []byte) (name string, value interface{}, err error) {
+	request, err := decodeRequest(data, true)
+	return request.Name, request.Value, err
+}
+
+// Decode a message like DecodeMessage, along with the token and version it was sent with, so that
+// servers can check what the client is allowed to do and answer in the same version.  Unlike
+// DecodeMessage, messages from newer versions are rejected with a VersionError, since the server
+// can't answer them in their version.
+func DecodeRequest(data []byte) (Request, error) {
+	return decodeRequest(data, false)
+}
+
+// Decode a message, accepting ones from newer versions if newer is true.
+func decodeRequest(data []byte, newer bool) (Request, error) {
+	named, err := DecodeNamedType(data)
+	if err != nil {
+		return Request{}, err
+	}
+
+	if named.Version < MinProtocolVersion || (named.Version > ProtocolVersion && !newer) {
+		return Request{Name: named.Name, Token: named.Token, Version: named.Version}, VersionError{Name: named.Name, Version: named.Version}
+	}
+
+	name, translated, err := translate(named)
+	if err != nil {
+		return Request{Name: named.Name, Token: named.Token, Version: named.Version}, err
+	}
+
+	messageType, ok := messages[name]
+	if !ok {
+		return Request{Name: name, Token: named.Token, Version: named.Version}, UnknownMessageError{Name: name}
+	}
+
+	// Messages are decoded straight from the data unless they had to be translated.
+	result := reflect.New(messageType)
+	if translated == nil {
+		err = decodeValue(data, result.Interface())
+	} else {
+		err = convertValue(translated, result.Interface())
+	}
+	if err != nil {
+		return Request{Name: name, Token: named.Token, Version: named.Version}, fmt.Errorf("malformed %s: %s", name, err)
+	}
+
+	return Request{Name: name, Value: result.Elem().Interface(), Token: named.Token, Version: named.Version}, nil
+}
+
+// Decode the Value of an encoded NamedType into target, which is a pointer to a struct or slice.
+// Decoding straight into the target lets the codec check the types of the fields.  The NamedType
+// tag (0xd8 0x4e) is skipped so that the envelope can be decoded as a plain struct.
+func decodeValue(data []byte, target interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	if len(data) < 2 || data[0] != 0xd8 || data[1] != 78 {
+		return fmt.Errorf("not a NamedType")
+	}
+	data = data[2:]
+
+	envelope := RawNamedType{Value: target}
+	return codec.NewDecoderBytes(data, new(codec.CborHandle)).Decode(&envelope)
+}
+
+// Convert a value that was decoded as an interface{}, usually a map[interface{}]interface{}, into
+// target, which is a pointer to a struct or slice.  The value is encoded again and decoded into
+// the target, so that the codec checks the types of the fields.
+func convertValue(value interface{}, target interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	var data []byte
+	var h = new(codec.CborHandle)
+
+	err = codec.NewEncoderBytes(&data, h).Encode(value)
+	if err != nil {
+		return err
+	}
+
+	return codec.NewDecoderBytes(data, h).Decode(target)
+}
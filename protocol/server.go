@@ -3,43 +3,70 @@ package protocol
 import (
 	"github.com/go-mangos/mangos"
 	"github.com/go-mangos/mangos/protocol/rep"
-	"github.com/go-mangos/mangos/transport/tcp"
 )
 
 type Responder func([]byte) []byte
 
+// Largest request the server accepts, which limits the size of a TrainBatch.
+const MaxRequestSize = 64 * 1024 * 1024
+
 type Server struct {
 	sock mangos.Socket
 }
 
 // Sets up the server-side socket for receiving training packets on tcp://localhost:4567.
-func Listen(url string) Server {
+// Exits if the socket can't be set up.
+func Listen(url string, options Options) Server {
+	server, err := NewServer(url, options)
+	if err != nil {
+		die("can't listen on rep socket: %s", err.Error())
+	}
+
+	return server
+}
+
+// Like Listen, but returns an error instead of exiting.
+func NewServer(url string, options Options) (Server, error) {
 	var sock mangos.Socket
 	var err error
 
 	if sock, err = rep.NewSocket(); err != nil {
-		die("can't get new rep socket: %s", err)
+		return Server{}, err
 	}
 
-	sock.AddTransport(tcp.NewTransport())
-	if err = sock.Listen(url); err != nil {
-		die("can't listen on rep socket: %s", err.Error())
+	// The default limit is too small for batches of training packets.
+	if err = sock.SetOption(mangos.OptionMaxRecvSize, MaxRequestSize); err != nil {
+		sock.Close()
+		return Server{}, err
+	}
+
+	if err = listenSocket(sock, url, options); err != nil {
+		sock.Close()
+		return Server{}, err
 	}
 
 	return Server{
 		sock: sock,
-	}
+	}, nil
+}
+
+func (self Server) Close() error {
+	return self.sock.Close()
 }
 
 // Runs in a continuous for loop to accept incoming training packets.  The responder input
 // is a function that accepts a byte array and returns a byte array.
-func (self Server) Accept(responder Responder) []byte {
+// Returns mangos.ErrClosed once the server has been closed, so the loop knows to stop.
+func (self Server) Accept(responder Responder) ([]byte, error) {
 	var err error
 	var msg []byte
 	var response []byte
 
 	// Could also use sock.RecvMsg to get header
 	msg, err = self.sock.Recv()
+	if err != nil {
+		return nil, err
+	}
 	//	fmt.Println("server received request:", string(msg))
 
 	// Handle the received training packet and send the transformation back to the client
@@ -47,9 +74,9 @@ func (self Server) Accept(responder Responder) []byte {
 	response = responder(msg)
 	err = self.sock.Send(response)
 	if err != nil {
-		die("can't send reply: %s", err.Error())
+		return msg, err
 	}
 
 	// Return the original received training packet (a byte array).
-	return msg
+	return msg, nil
 }
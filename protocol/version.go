@@ -0,0 +1,154 @@
+package protocol
+
+import (
+	"fmt"
+)
+
+// Every NamedType carries the version of the messages it was encoded with.  When a message
+// changes in a way that an older server or client would misread, bump ProtocolVersion and add a
+// Translation from the older version, and a downgrade back to it if older clients receive that
+// message.  Servers answer each request in the version it was sent in, and publish rules in
+// MinProtocolVersion, so older clients keep working.  Version 0 is the clients and servers from
+// before messages had versions.
+const (
+	ProtocolVersion    = 1 // version of the messages this package sends
+	MinProtocolVersion = 0 // oldest version that is accepted, older messages are rejected
+)
+
+// Sent by clients to find out which versions of the messages a server understands.  The server
+// answers with its own Hello.
+type Hello struct {
+	Version    int // newest version the sender understands
+	MinVersion int // oldest version the sender understands
+}
+
+// Returned by DecodeMessage for a message from a version that isn't supported.
+type VersionError struct {
+	Name    string
+	Version int
+	Reason  string // why the message couldn't be translated, "" if the version is out of range
+}
+
+func (self VersionError) Error() string {
+	if self.Reason != "" {
+		return fmt.Sprintf("can't translate version %d of %s: %s", self.Version, self.Name, self.Reason)
+	}
+
+	return fmt.Sprintf("unsupported version %d of %s, versions %d to %d are supported", self.Version, self.Name, MinProtocolVersion, ProtocolVersion)
+}
+
+// Turns a message from one version into the next version up.  The value is the message as it
+// was decoded, so that fields can be added, renamed or checked for.  Returns the message's name in
+// the next version, which is usually the same, or an error if the message can't be translated.
+type Translation func(value map[interface{}]interface{}) (string, map[interface{}]interface{}, error)
+
+// Translations from each version to the next, by message name.  Messages without a translation
+// are decoded as they are, with any missing fields left as zero values.
+var translations = map[int]map[string]Translation{
+	0: {
+		"protocol.TrainPacket": translateTrainPacket0,
+	},
+}
+
+// Translations from each version to the one before it, by message name, for the messages that
+// servers send to older clients.  Messages without a downgrade are sent as they are, which is fine
+// as long as older clients can ignore the fields they don't know about.
+var downgrades = map[int]map[string]Translation{}
+
+// Clients before version 1 sent test packets as "protocol.TrainPacket", without a label.  They
+// can't be scored without a label and must not be trained on.
+func translateTrainPacket0(value map[interface{}]interface{}) (string, map[interface{}]interface{}, error) {
+	if _, ok := value["AllowBlock"]; !ok {
+		return "", nil, fmt.Errorf("test packets without labels aren't supported")
+	}
+
+	return "protocol.TrainPacket", value, nil
+}
+
+// Bring a message from an older version up to ProtocolVersion.  Returns a nil value if there
+// weren't any translations for the message, so that it can be decoded as it was sent.
+func translate(named NamedType) (string, map[interface{}]interface{}, error) {
+	var translated map[interface{}]interface{}
+	name := named.Name
+	value := named.Value
+
+	for version := named.Version; version < ProtocolVersion; version++ {
+		translation, ok := translations[version][name]
+		if !ok {
+			continue
+		}
+
+		fields, ok := value.(map[interface{}]interface{})
+		if !ok {
+			return name, nil, fmt.Errorf("malformed %s", name)
+		}
+
+		var err error
+		name, translated, err = translation(fields)
+		if err != nil {
+			return named.Name, nil, VersionError{Name: named.Name, Version: named.Version, Reason: err.Error()}
+		}
+		value = translated
+	}
+
+	return name, translated, nil
+}
+
+// Take a message in version from down to version to.  The value is only converted to a map if
+// there is a downgrade for it, otherwise it is returned as it was.
+func downgrade(name string, value interface{}, from int, to int) (string, interface{}, error) {
+	original := name
+
+	for version := from; version > to; version-- {
+		translation, ok := downgrades[version][name]
+		if !ok {
+			continue
+		}
+
+		fields, ok := value.(map[interface{}]interface{})
+		if !ok {
+			err := convertValue(value, &fields)
+			if err != nil {
+				return original, nil, fmt.Errorf("malformed %s: %s", name, err)
+			}
+		}
+
+		var err error
+		name, fields, err = translation(fields)
+		if err != nil {
+			return original, nil, VersionError{Name: original, Version: to, Reason: err.Error()}
+		}
+		value = fields
+	}
+
+	return name, value, nil
+}
+
+// The version to answer a request in, given the version it was sent in: the same one if it is
+// supported, otherwise the nearest one that is.
+func ReplyVersion(version int) int {
+	if version > ProtocolVersion {
+		return ProtocolVersion
+	} else if version < MinProtocolVersion {
+		return MinProtocolVersion
+	}
+
+	return version
+}
+
+// The Hello that servers answer with.
+func ServerHello() Hello {
+	return Hello{Version: ProtocolVersion, MinVersion: MinProtocolVersion}
+}
+
+// The Response to send for an error from DecodeMessage.
+func DecodeErrorResponse(err error) Response {
+	switch err.(type) {
+	case UnknownMessageError:
+		return ErrorResponse(UnknownRequest, err.Error())
+	case VersionError:
+		return ErrorResponse(UnsupportedVersion, err.Error())
+	default:
+		return ErrorResponse(DecodeFailed, err.Error())
+	}
+}
@@ -1,16 +1,30 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"os"
 	"runtime"
+	"strings"
 
 	"github.com/OperatorFoundation/AdversaryLab/storage"
+	"github.com/OperatorFoundation/AdversaryLab/protocol"
 	"github.com/OperatorFoundation/AdversaryLab/services"
 )
 
 // This is the server class that receives the training packets and sends out rules to subscribers.
 
 func main() {
+	var storePath = flag.String("store", "store", "directory that holds the lab's datasets")
+	var ingestAddress = flag.String("ingest", ":4571", "address to stream training packets to without waiting for replies, a port such as \":4571\" to listen on -host like the other sockets, \"\" to turn it off")
+	var httpAddress = flag.String("http", ":4572", "address of the HTTP/JSON API, a port such as \":4572\" to listen on -host, \"\" to turn it off")
+	var host = flag.String("host", "localhost", "host name or address the services listen on")
+	var certFile = flag.String("tls-cert", "", "PEM certificate for the services, which turns on TLS")
+	var keyFile = flag.String("tls-key", "", "PEM key for -tls-cert")
+	var clientCAFile = flag.String("tls-client-ca", "", "PEM CA that clients' certificates have to be signed by, \"\" to not require client certificates")
+	var aclPath = flag.String("acl", "", "JSON file of the tokens clients can use and the datasets each can train on, \"\" to allow everyone")
+	flag.Parse()
+
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
 	// channel of best rule updates ("dataset1-incoming" + rule candidate)
@@ -19,23 +33,75 @@ func main() {
 	fmt.Println("*** INIT")
 
 	// map from keys ("dataset1-incoming") to the store containing the training packet
-	// payloads (both index and source files).
-	// later on, keys ("dataset1-incoming") are reset to map to the store containing
-	// the offset/subsequence pairs (both index and source files, but not countmap file).
-	// need to investigate the storeCache a bit more because it seems worrying that the
-	// map could be changing each time a new training packet is sent or a new best rule is
-	// generated.
-	storeCache := storage.NewStoreCache()
-
-	train := services.NewTrainPacketService("tcp://localhost:4567", updates, storeCache)
-	//	test := services.NewTestPacketService("tcp://localhost:4569", updates)
+	// payloads (both index and source files), and from keys ("dataset1-incoming-offsets-sequence")
+	// to the store containing the offset/subsequence pairs. All of the stores are in the
+	// directory given by -store, so several labs can be run from different directories.
+	root, err := storage.NewRoot(*storePath)
+	if err != nil {
+		fmt.Println("Error opening store directory", err)
+		os.Exit(1)
+	}
+
+	storeCache := storage.NewStoreCache(root)
+
+	// With a certificate, every socket uses TLS, so clients connect to "tls+tcp://" addresses.
+	options := protocol.DefaultOptions()
+	scheme := "tcp://"
+	if *certFile != "" {
+		options.TLSConfig, err = protocol.ServerTLSConfig(*certFile, *keyFile, *clientCAFile)
+		if err != nil {
+			fmt.Println("Error loading certificates", err)
+			os.Exit(1)
+		}
+		scheme = "tls+tcp://"
+	}
+
+	var acl *services.ACL
+	if *aclPath != "" {
+		acl, err = services.LoadACL(*aclPath)
+		if err != nil {
+			fmt.Println("Error loading ACL", err)
+			os.Exit(1)
+		}
+	}
+
+	// A bare port listens on the same host as the other sockets, with TLS if they have it.
+	if strings.HasPrefix(*ingestAddress, ":") {
+		*ingestAddress = scheme + *host + *ingestAddress
+	}
+
+	// The ingestion socket would otherwise be the one way in without a certificate.
+	if *ingestAddress != "" && options.TLSConfig != nil && strings.HasPrefix(*ingestAddress, "tcp://") {
+		*ingestAddress = "tls+" + *ingestAddress
+	}
+
+	address := func(port int) string {
+		return fmt.Sprintf("%s%s:%d", scheme, *host, port)
+	}
+
+	// The training service answers rule queries with the prefixes the rule service has.
+	rule := services.NewRuleService(address(4568), address(4570), updates, storeCache, options, acl)
+	train := services.NewTrainPacketService(address(4567), *ingestAddress, updates, rule, storeCache, options, acl)
 	fmt.Println("2")
-	rule := services.NewRuleService("tcp://localhost:4568", updates, storeCache)
+	test := services.NewTestPacketService(address(4569), rule, options, acl)
+
+	// A bare port listens on the same host as the other services.
+	if strings.HasPrefix(*httpAddress, ":") {
+		*httpAddress = *host + *httpAddress
+	}
+
+	var api *services.HTTPService
+	if *httpAddress != "" {
+		api = services.NewHTTPService(*httpAddress, train, rule, test, options, acl)
+	}
 
 	fmt.Println("*** RUN")
 
 	go train.Run()
-	//	go test.Run()
+	go test.Run()
+	if api != nil {
+		go api.Run()
+	}
 	rule.Run()
 
 	fmt.Println("*** FINISHED")
@@ -0,0 +1,56 @@
+package services
+
+import (
+	"encoding/json"
+	"io/ioutil"
+)
+
+// Which clients can use the lab, by the token they send with their requests.  Each token can
+// train on the datasets it lists, or on every dataset if it lists "*", and can read the rules and
+// test stats of every dataset.  A token that isn't listed can't do anything but Hello.  A nil ACL
+// lets everyone do everything, which is how the lab is run on a machine of its own.
+type ACL struct {
+	Tokens map[string][]string // token to the datasets it can train on
+}
+
+// Load an ACL from a JSON file such as
+//
+//	{"Tokens": {"secret1": ["dataset1", "dataset2"], "secret2": ["*"]}}
+func LoadACL(path string) (*ACL, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	acl := &ACL{}
+	if err = json.Unmarshal(data, acl); err != nil {
+		return nil, err
+	}
+
+	return acl, nil
+}
+
+// True if the token can read rules and test stats.
+func (self *ACL) CanRead(token string) bool {
+	if self == nil {
+		return true
+	}
+
+	_, ok := self.Tokens[token]
+	return ok
+}
+
+// True if the token can add training or test packets to the dataset (i.e. "dataset1").
+func (self *ACL) CanWrite(token string, dataset string) bool {
+	if self == nil {
+		return true
+	}
+
+	for _, allowed := range self.Tokens[token] {
+		if allowed == "*" || allowed == dataset {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,96 @@
+package services
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestACL(t *testing.T) {
+	acl := &ACL{Tokens: map[string][]string{
+		"reader":  {},
+		"trainer": {"dataset1", "my-set"},
+		"admin":   {"*"},
+	}}
+
+	tests := []struct {
+		acl      *ACL
+		token    string
+		dataset  string
+		canRead  bool
+		canWrite bool
+	}{
+		{acl, "", "dataset1", false, false},
+		{acl, "unknown", "dataset1", false, false},
+		{acl, "reader", "dataset1", true, false},
+		{acl, "trainer", "dataset1", true, true},
+		{acl, "trainer", "my-set", true, true},
+		{acl, "trainer", "dataset2", true, false},
+		{acl, "trainer", "dataset", true, false},
+		{acl, "trainer", "*", true, false},
+		{acl, "admin", "dataset2", true, true},
+		{nil, "", "dataset1", true, true},
+		{nil, "unknown", "dataset2", true, true},
+	}
+
+	for _, test := range tests {
+		if test.acl.CanRead(test.token) != test.canRead {
+			t.Error("Wrong CanRead", test.acl != nil, test.token, test.canRead)
+		}
+		if test.acl.CanWrite(test.token, test.dataset) != test.canWrite {
+			t.Error("Wrong CanWrite", test.acl != nil, test.token, test.dataset, test.canWrite)
+		}
+	}
+}
+
+func TestLoadACL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "adversarylab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		contents string
+		valid    bool
+	}{
+		{`{"Tokens": {"secret1": ["dataset1", "dataset2"], "secret2": ["*"]}}`, true},
+		{`{"Tokens": {}}`, true},
+		{`{"Tokens": {"secret1": "dataset1"}}`, false},
+		{`not json`, false},
+	}
+
+	for i, test := range tests {
+		path := filepath.Join(dir, "acl.json")
+		err = ioutil.WriteFile(path, []byte(test.contents), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		acl, err := LoadACL(path)
+		if test.valid != (err == nil) || test.valid != (acl != nil) {
+			t.Error("Wrong result loading ACL", i, acl, err)
+		}
+	}
+
+	acl, err := LoadACL(filepath.Join(dir, "acl.json"))
+	if err == nil || acl != nil {
+		t.Error("Loaded an invalid ACL", acl)
+	}
+
+	acl, err = LoadACL(filepath.Join(dir, "missing.json"))
+	if err == nil || acl != nil {
+		t.Error("Loaded a missing ACL", acl)
+	}
+
+	// A loaded ACL works like one that was built.
+	ioutil.WriteFile(filepath.Join(dir, "acl.json"), []byte(tests[0].contents), 0666)
+	acl, err = LoadACL(filepath.Join(dir, "acl.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !acl.CanWrite("secret1", "dataset2") || acl.CanWrite("secret1", "dataset3") || !acl.CanWrite("secret2", "dataset3") || acl.CanRead("secret3") {
+		t.Error("Wrong permissions from loaded ACL", acl)
+	}
+}
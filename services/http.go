@@ -0,0 +1,325 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/OperatorFoundation/AdversaryLab/protocol"
+)
+
+// The HTTP service lets programs that don't speak the mangos and CBOR protocol, such as notebooks
+// and browser dashboards, use the lab.  Requests and replies are JSON, with the same fields as the
+// protocol's messages.  Byte fields such as payloads and rule sequences are base64.
+//
+//	POST /train          a TrainPacket, or {"Packets": [...]} for many, answered with a Response
+//	GET  /datasets       the datasets and directions in the store
+//	GET  /rules          the latest rule for every dataset and direction, ?dataset= for one dataset
+//	GET  /rules/top      the best rules for ?dataset= and ?incoming=true or false
+//	GET  /stats          the test counts for ?dataset= and ?incoming=
+//	GET  /events         Server-Sent Events, a "rule" event for each rule the rule service sends
+//
+// Clients send their token as "Authorization: Bearer <token>" or, since browsers can't set headers
+// on event streams, as ?token=.  Errors are a Response with the status and an HTTP status to match,
+// or 405 with an Allow header for the wrong method.
+type HTTPService struct {
+	server *http.Server
+	train  *TrainService
+	rules  *RuleService
+	test   *TestService
+	acl    *ACL // which tokens can read and train on what, nil to allow everyone
+}
+
+// How long a client can take to send the headers of a request, so that slow clients can't hold
+// connections open.  Bodies and event streams aren't limited.
+const httpHeaderTimeout = 10 * time.Second
+
+// A dataset and direction in the store, for GET /datasets.
+type DatasetInfo struct {
+	Dataset  string
+	Incoming bool
+}
+
+// The server side for HTTP clients
+// Listen address is set up to be localhost:4572.  HTTPS is used if options has a TLSConfig.
+func NewHTTPService(listenAddress string, train *TrainService, rules *RuleService, test *TestService, options protocol.Options, acl *ACL) *HTTPService {
+	service := &HTTPService{train: train, rules: rules, test: test, acl: acl}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/train", service.handleTrain)
+	mux.HandleFunc("/datasets", service.handleDatasets)
+	mux.HandleFunc("/rules", service.handleRules)
+	mux.HandleFunc("/rules/top", service.handleTopRules)
+	mux.HandleFunc("/stats", service.handleStats)
+	mux.HandleFunc("/events", service.handleEvents)
+
+	service.server = &http.Server{Addr: listenAddress, Handler: mux, TLSConfig: options.TLSConfig, ReadHeaderTimeout: httpHeaderTimeout}
+	return service
+}
+
+// Goroutine spawned by the AdversaryLab/server.go that answers HTTP requests.
+func (self *HTTPService) Run() {
+	var err error
+	if self.server.TLSConfig != nil {
+		// The certificate is already in the TLSConfig.
+		err = self.server.ListenAndServeTLS("", "")
+	} else {
+		err = self.server.ListenAndServe()
+	}
+
+	if err != nil && err != http.ErrServerClosed {
+		fmt.Println("Error serving HTTP")
+		fmt.Println(err)
+	}
+}
+
+func (self *HTTPService) Close() error {
+	return self.server.Close()
+}
+
+// Store training packets, answering with the index of each one.
+func (self *HTTPService) handleTrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, r, http.MethodPost)
+		return
+	}
+
+	// A single packet or a batch, whichever the client sent.
+	var body struct {
+		protocol.TrainPacket
+		Packets []protocol.TrainPacket
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, protocol.MaxRequestSize)
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, protocol.DecodeFailed, "Malformed training packet: "+err.Error())
+		return
+	}
+
+	if body.Packets == nil {
+		indices, response := self.train.handlers.train([]protocol.TrainPacket{body.TrainPacket}, requestToken(r))
+		response.Index = indices[0]
+		writeResponse(w, response)
+		return
+	}
+
+	indices, response := self.train.handlers.train(body.Packets, requestToken(r))
+	response.Value = indices
+	writeResponse(w, response)
+}
+
+// List the datasets and directions that have training packets.
+func (self *HTTPService) handleDatasets(w http.ResponseWriter, r *http.Request) {
+	if !self.canRead(w, r) {
+		return
+	}
+
+	names, err := self.train.handlers.storeCache.Root.ListDatasets()
+	if err != nil {
+		writeError(w, protocol.StoreFailed, "Could not read store directory: "+err.Error())
+		return
+	}
+
+	datasets := []DatasetInfo{}
+	for _, name := range names {
+		// Store names are i.e. "dataset1-incoming".
+		dataset, incoming, ok := splitDatasetName(name)
+		if !ok {
+			continue
+		}
+
+		datasets = append(datasets, DatasetInfo{Dataset: dataset, Incoming: incoming})
+	}
+
+	writeResponse(w, protocol.NewResponse(datasets))
+}
+
+// The latest rule for every dataset and direction, or for one dataset.
+func (self *HTTPService) handleRules(w http.ResponseWriter, r *http.Request) {
+	if !self.canRead(w, r) {
+		return
+	}
+
+	snapshot := self.rules.Snapshot()
+	if dataset := r.URL.Query().Get("dataset"); dataset != "" {
+		rules := []protocol.Rule{}
+		for _, rule := range snapshot.Rules {
+			if rule.Dataset == dataset {
+				rules = append(rules, rule)
+			}
+		}
+		snapshot.Rules = rules
+	}
+
+	writeResponse(w, protocol.NewResponse(snapshot))
+}
+
+// The best rules found so far for a dataset and direction, best first.
+func (self *HTTPService) handleTopRules(w http.ResponseWriter, r *http.Request) {
+	if !self.canRead(w, r) {
+		return
+	}
+
+	dataset, incoming, ok := datasetQuery(w, r)
+	if !ok {
+		return
+	}
+
+	top := protocol.TopRules{Dataset: dataset, Incoming: incoming, Rules: self.train.handlers.topRules(datasetName(dataset, incoming))}
+
+	writeResponse(w, protocol.NewResponse(top))
+}
+
+// The test counts for a dataset and direction.
+func (self *HTTPService) handleStats(w http.ResponseWriter, r *http.Request) {
+	if !self.canRead(w, r) {
+		return
+	}
+
+	dataset, incoming, ok := datasetQuery(w, r)
+	if !ok {
+		return
+	}
+
+	writeResponse(w, protocol.NewResponse(self.test.Stats(dataset, incoming)))
+}
+
+// Stream the rules as they are sent, starting with the latest rule for every dataset and
+// direction like the snapshot socket does.  ?dataset= only streams the rules for one dataset.
+func (self *HTTPService) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if !self.canRead(w, r) {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, protocol.InternalError, "Streaming isn't supported")
+		return
+	}
+
+	// Watch before taking the snapshot so that no rules are missed in between.
+	watcher := self.rules.Watch()
+	defer self.rules.Unwatch(watcher)
+
+	dataset := r.URL.Query().Get("dataset")
+	send := func(rule protocol.Rule) error {
+		if dataset != "" && rule.Dataset != dataset {
+			return nil
+		}
+
+		data, err := json.Marshal(rule)
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintf(w, "event: rule\ndata: %s\n\n", data)
+		return err
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	for _, rule := range self.rules.Snapshot().Rules {
+		if send(rule) != nil {
+			return
+		}
+	}
+	flusher.Flush()
+
+	for {
+		select {
+		case rule := <-watcher:
+			if send(rule) != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// Check that the request's token can read the rules and stats, answering it if it can't.
+func (self *HTTPService) canRead(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, r, http.MethodGet)
+		return false
+	}
+
+	if !self.acl.CanRead(requestToken(r)) {
+		writeError(w, protocol.Forbidden, "Unknown token")
+		return false
+	}
+
+	return true
+}
+
+// The token from the Authorization header, or from the query for event streams.
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+
+	return r.URL.Query().Get("token")
+}
+
+// Read ?dataset= and ?incoming=, answering the request if either is missing.
+func datasetQuery(w http.ResponseWriter, r *http.Request) (string, bool, bool) {
+	query := r.URL.Query()
+	dataset := query.Get("dataset")
+	direction := query.Get("incoming")
+	if dataset == "" || (direction != "true" && direction != "false") {
+		writeError(w, protocol.InvalidRequest, "dataset and incoming=true or false are required")
+		return "", false, false
+	}
+
+	return dataset, direction == "true", true
+}
+
+func writeError(w http.ResponseWriter, status protocol.ResultStatus, message string) {
+	writeResponse(w, protocol.ErrorResponse(status, message))
+}
+
+// Answer a request that used the wrong method with 405 and the method it should have used.
+func writeMethodNotAllowed(w http.ResponseWriter, r *http.Request, allowed string) {
+	w.Header().Set("Allow", allowed)
+	writeResponseStatus(w, protocol.ErrorResponse(protocol.InvalidRequest, r.URL.Path+" only answers "+allowed+" requests"), http.StatusMethodNotAllowed)
+}
+
+func writeResponse(w http.ResponseWriter, response protocol.Response) {
+	writeResponseStatus(w, response, httpStatus(response.Status))
+}
+
+// Write the response with an HTTP status other than the one that matches its status.
+func writeResponseStatus(w http.ResponseWriter, response protocol.Response, status int) {
+	data, err := json.Marshal(response)
+	if err != nil {
+		response = protocol.ErrorResponse(protocol.InternalError, "Error encoding response: "+err.Error())
+		data, _ = json.Marshal(response)
+		status = httpStatus(response.Status)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+// The HTTP status for a ResultStatus.
+func httpStatus(status protocol.ResultStatus) int {
+	switch status {
+	case protocol.Success:
+		return http.StatusOK
+	case protocol.DecodeFailed, protocol.InvalidRequest, protocol.UnsupportedVersion:
+		return http.StatusBadRequest
+	case protocol.UnknownRequest:
+		return http.StatusNotFound
+	case protocol.Forbidden:
+		return http.StatusForbidden
+	case protocol.Busy:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,233 @@
+package services
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/OperatorFoundation/AdversaryLab/protocol"
+)
+
+// An HTTP API in front of services that don't have sockets, with the updates thrown away.
+func testHTTPServer(t *testing.T, acl *ACL) (*httptest.Server, *HTTPService) {
+	cache := testStoreCache(t)
+	rules := &RuleService{source: make(protocol.PubsubSource, 100), latest: make(map[string]*protocol.Rule), watchers: make(map[chan protocol.Rule]bool), acl: acl}
+	train := &TrainService{handlers: testHandlers(cache, acl)}
+	train.handlers.rules = rules
+	test := &TestService{rules: rules, stats: make(map[string]*protocol.TestStats), acl: acl}
+
+	service := NewHTTPService("", train, rules, test, protocol.DefaultOptions(), acl)
+	server := httptest.NewServer(service.server.Handler)
+	t.Cleanup(func() {
+		server.Close()
+		os.RemoveAll(cache.Root.Path)
+	})
+
+	return server, service
+}
+
+// Send a request and decode the Response, checking the HTTP status.  value gets the Response's Value.
+func testRequest(t *testing.T, method string, url string, token string, body string, status int, value interface{}) {
+	request, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != status {
+		t.Error("Wrong HTTP status", method, url, response.StatusCode)
+	}
+	if status == http.StatusMethodNotAllowed && response.Header.Get("Allow") == "" {
+		t.Error("No Allow header", method, url)
+	}
+
+	decoded := struct {
+		Status protocol.ResultStatus
+		Error  string
+		Index  int64
+		Value  json.RawMessage
+	}{}
+	err = json.NewDecoder(response.Body).Decode(&decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != nil && len(decoded.Value) > 0 {
+		err = json.Unmarshal(decoded.Value, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if index, ok := value.(*int64); ok {
+		*index = decoded.Index
+	}
+}
+
+func TestHTTPTrain(t *testing.T) {
+	server, _ := testHTTPServer(t, nil)
+
+	// "R0VU" is "GET".
+	var index int64
+	testRequest(t, "POST", server.URL+"/train", "", `{"Dataset": "my-set", "AllowBlock": true, "Incoming": true, "Payload": "R0VU"}`, http.StatusOK, &index)
+	if index != 0 {
+		t.Error("Wrong index", index)
+	}
+
+	var indices []int64
+	testRequest(t, "POST", server.URL+"/train", "", `{"Packets": [{"Dataset": "my-set", "AllowBlock": true, "Incoming": true, "Payload": "R0VU"}, {"Dataset": "my-set", "AllowBlock": false, "Incoming": true, "Payload": "R0VU"}]}`, http.StatusOK, &indices)
+	if len(indices) != 2 || indices[0] != 1 || indices[1] != 2 {
+		t.Error("Wrong indices", indices)
+	}
+
+	testRequest(t, "POST", server.URL+"/train", "", `{"Dataset": "my-set", "Incoming": true}`, http.StatusBadRequest, nil)
+	testRequest(t, "POST", server.URL+"/train", "", `not json`, http.StatusBadRequest, nil)
+	testRequest(t, "GET", server.URL+"/train", "", "", http.StatusMethodNotAllowed, nil)
+
+	// Dataset names with a "-" in them are listed whole.
+	var datasets []DatasetInfo
+	testRequest(t, "GET", server.URL+"/datasets", "", "", http.StatusOK, &datasets)
+	if len(datasets) != 1 || datasets[0].Dataset != "my-set" || !datasets[0].Incoming {
+		t.Error("Wrong datasets", datasets)
+	}
+}
+
+func TestHTTPRules(t *testing.T) {
+	server, service := testHTTPServer(t, nil)
+
+	service.rules.publish("dataset1-incoming", &protocol.Rule{Dataset: "dataset1", Incoming: true, Sequence: []byte{0, 0, 'G'}})
+	service.rules.publish("my-set-incoming", &protocol.Rule{Dataset: "my-set", Incoming: true, Sequence: []byte{0, 0, 'P'}})
+	service.rules.publish("my-set-outgoing", &protocol.Rule{Dataset: "my-set", Incoming: false, Sequence: []byte{0, 0, 'H'}})
+
+	var snapshot protocol.RuleSnapshot
+	testRequest(t, "GET", server.URL+"/rules", "", "", http.StatusOK, &snapshot)
+	if len(snapshot.Rules) != 3 {
+		t.Error("Wrong rules", snapshot.Rules)
+	}
+
+	snapshot = protocol.RuleSnapshot{}
+	testRequest(t, "GET", server.URL+"/rules?dataset=my-set", "", "", http.StatusOK, &snapshot)
+	if len(snapshot.Rules) != 2 || snapshot.Rules[0].Dataset != "my-set" || snapshot.Rules[1].Dataset != "my-set" {
+		t.Error("Wrong rules for my-set", snapshot.Rules)
+	}
+
+	snapshot = protocol.RuleSnapshot{}
+	testRequest(t, "GET", server.URL+"/rules?dataset=unknown", "", "", http.StatusOK, &snapshot)
+	if len(snapshot.Rules) != 0 {
+		t.Error("Wrong rules for an unknown dataset", snapshot.Rules)
+	}
+
+	var top protocol.TopRules
+	testRequest(t, "GET", server.URL+"/rules/top?dataset=my-set&incoming=true", "", "", http.StatusOK, &top)
+	if top.Dataset != "my-set" || !top.Incoming || len(top.Rules) != 0 {
+		t.Error("Wrong top rules", top)
+	}
+	testRequest(t, "GET", server.URL+"/rules/top?dataset=my-set", "", "", http.StatusBadRequest, nil)
+
+	var stats protocol.TestStats
+	testRequest(t, "GET", server.URL+"/stats?dataset=my-set&incoming=false", "", "", http.StatusOK, &stats)
+	testRequest(t, "POST", server.URL+"/stats?dataset=my-set&incoming=false", "", "", http.StatusMethodNotAllowed, nil)
+}
+
+func TestHTTPForbidden(t *testing.T) {
+	acl := &ACL{Tokens: map[string][]string{"reader": {}, "trainer": {"my-set"}}}
+	server, _ := testHTTPServer(t, acl)
+
+	packet := `{"Dataset": "my-set", "AllowBlock": true, "Incoming": true, "Payload": "R0VU"}`
+	testRequest(t, "POST", server.URL+"/train", "", packet, http.StatusForbidden, nil)
+	testRequest(t, "POST", server.URL+"/train", "reader", packet, http.StatusForbidden, nil)
+	testRequest(t, "POST", server.URL+"/train", "trainer", packet, http.StatusOK, nil)
+	testRequest(t, "POST", server.URL+"/train", "trainer", `{"Dataset": "other", "AllowBlock": true, "Incoming": true, "Payload": "R0VU"}`, http.StatusForbidden, nil)
+
+	for _, path := range []string{"/datasets", "/rules", "/rules/top?dataset=my-set&incoming=true", "/stats?dataset=my-set&incoming=true", "/events"} {
+		testRequest(t, "GET", server.URL+path, "", "", http.StatusForbidden, nil)
+		testRequest(t, "GET", server.URL+path, "unknown", "", http.StatusForbidden, nil)
+	}
+	testRequest(t, "GET", server.URL+"/rules", "reader", "", http.StatusOK, nil)
+	testRequest(t, "GET", server.URL+"/rules?token=reader", "", "", http.StatusOK, nil)
+}
+
+func TestHTTPEvents(t *testing.T) {
+	acl := &ACL{Tokens: map[string][]string{"reader": {}}}
+	server, service := testHTTPServer(t, acl)
+
+	service.rules.publish("dataset1-incoming", &protocol.Rule{Dataset: "dataset1", Incoming: true, Sequence: []byte{0, 0, 'G'}})
+	service.rules.publish("my-set-incoming", &protocol.Rule{Dataset: "my-set", Incoming: true, Sequence: []byte{0, 0, 'P'}})
+
+	// Browsers can't set headers on event streams, so the token is in the query.
+	response, err := http.Get(server.URL + "/events?dataset=my-set&token=reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK || response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatal("Wrong event stream response", response.StatusCode, response.Header.Get("Content-Type"))
+	}
+
+	reader := bufio.NewReader(response.Body)
+	readEvent := func() protocol.Rule {
+		var rule protocol.Rule
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if strings.HasPrefix(line, "data: ") {
+				err = json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &rule)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return rule
+			}
+		}
+	}
+
+	// The first event is the latest rule for the dataset, without waiting for a new one.
+	rule := readEvent()
+	if rule.Dataset != "my-set" || string(rule.Sequence) != "\x00\x00P" {
+		t.Error("Wrong first event", rule)
+	}
+
+	// Rules for other datasets are skipped.
+	service.rules.publish("dataset1-incoming", &protocol.Rule{Dataset: "dataset1", Incoming: true, Sequence: []byte{0, 0, 'X'}})
+	service.rules.publish("my-set-outgoing", &protocol.Rule{Dataset: "my-set", Incoming: false, Sequence: []byte{0, 0, 'H'}})
+
+	rule = readEvent()
+	if rule.Dataset != "my-set" || rule.Incoming || string(rule.Sequence) != "\x00\x00H" {
+		t.Error("Wrong event", rule)
+	}
+}
+
+func TestSplitDatasetName(t *testing.T) {
+	tests := []struct {
+		name     string
+		dataset  string
+		incoming bool
+		ok       bool
+	}{
+		{"dataset1-incoming", "dataset1", true, true},
+		{"dataset1-outgoing", "dataset1", false, true},
+		{"my-set-incoming", "my-set", true, true},
+		{"my-set-outgoing", "my-set", false, true},
+		{"dataset1", "dataset1", false, false},
+	}
+
+	for _, test := range tests {
+		dataset, incoming, ok := splitDatasetName(test.name)
+		if dataset != test.dataset || incoming != test.incoming || ok != test.ok {
+			t.Error("Wrong split", test.name, dataset, incoming, ok)
+		}
+	}
+}
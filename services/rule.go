@@ -1,13 +1,11 @@
 package services
 
 import (
-	"bufio"
-	"bytes"
 	"fmt"
-	"io/ioutil"
-	"strings"
+	"sort"
+	"sync"
 
-	"github.com/ugorji/go/codec"
+	"github.com/go-mangos/mangos"
 
 	"github.com/OperatorFoundation/AdversaryLab/storage"
 	"github.com/OperatorFoundation/AdversaryLab/protocol"
@@ -23,6 +21,8 @@ type RuleHandler struct {
 	path       string			// i.e. "dataset1-incoming"
 	store      *storage.Store		// store containing the offset/subsequence rule candidates
 	cachedRule *storage.RuleCandidate	// initially set to nil
+	allowPrefix []byte			// latest prefix extracted from the allow bytemap
+	blockPrefix []byte			// latest prefix extracted from the block bytemap
 }
 
 type RuleService struct {
@@ -30,98 +30,236 @@ type RuleService struct {
 	serve    protocol.PubsubServer		// contains socket for sending out rules as bytes from PubsubSource
 	updates  chan Update			// contains the "dataset1-incoming"+best rule candidate updates; is incoming
 	source   protocol.PubsubSource		// channel to be used for sending out updates as bytes
+	snapshot protocol.Server		// contains socket for answering requests for the latest rules
+	latest   map[string]*protocol.Rule	// latest rule sent for each "dataset1-incoming"
+	watchers map[chan protocol.Rule]bool	// channels that get a copy of every rule sent, for the HTTP event stream
+	lock     sync.Mutex			// for latest and watchers, which the snapshot requests and the HTTP service use
+	acl      *ACL				// which tokens can ask for snapshots, nil to allow everyone
 }
 
+// Each watcher can fall this far behind before rules are dropped instead of holding up the
+// subscribers.
+const watcherQueueLength = 100
+
 // listenAddress is tcp://localhost:4568. updates contains the "dataset1-incoming"+best rule candidate updates
 // that should be sent out. Add the offsets-sequence store to the storeCache.
-func NewRuleService(listenAddress string, updates chan Update, storeCache *storage.StoreCache) *RuleService {
+// snapshotAddress is tcp://localhost:4570, where subscribers that just connected can ask for the
+// latest rule for every dataset instead of waiting for the next update.
+// options has the certificates for "tls+tcp://" addresses.  Subscribers don't send anything, so
+// the pub socket can only be protected with client certificates; acl only covers the snapshots.
+func NewRuleService(listenAddress string, snapshotAddress string, updates chan Update, storeCache *storage.StoreCache, options protocol.Options, acl *ACL) *RuleService {
 	// PubsubSource is just a byte channel that will be used to send out the updates to subscribers.
 	source := make(protocol.PubsubSource)
 
 	handlers := RuleHandlers{handlers: make(map[string]*RuleHandler), source: source, storeCache: storeCache}
-	files, err := ioutil.ReadDir("store")
+	names, err := storeCache.Root.ListDatasets()
 	if err != nil {
 		fmt.Println("Failed to read store directory", err)
 	} else {
-		// For all of the files in the store directory ("dataset1-incoming",
-		// "dataset1-incoming-offsets-sequence", 'dataset1-outgoing",
-		// "dataset1-outgoing-offsets-sequence")
-		for _, file := range files {
-			handlers.Load(file.Name())
+		// For all of the datasets in the store directory ("dataset1-incoming",
+		// 'dataset1-outgoing"), skipping the sequence stores derived from them
+		for _, name := range names {
+			handlers.Load(name)
 		}
 	}
 
-	serve := protocol.PubsubListen(listenAddress, source)
+	serve := protocol.PubsubListen(listenAddress, source, options)
+	snapshot := protocol.Listen(snapshotAddress, options)
 
-	return &RuleService{handlers: handlers, serve: serve, updates: updates, source: source}
+	return &RuleService{handlers: handlers, serve: serve, updates: updates, source: source, snapshot: snapshot, latest: make(map[string]*protocol.Rule), watchers: make(map[chan protocol.Rule]bool), acl: acl}
 }
 
 // go routine started from main server.  Retrieves rule updates from the socket and
 func (self *RuleService) Run() {
 	go self.handleUpdates()
+	go self.serveSnapshots()
 	self.serve.Pump()
 }
 
-// Update the storecache so the keys (i.e. "dataset1-incoming") map to the store that recorded
-// the offset/subsequence combinations.
-func (self RuleHandlers) Load(name string) *RuleHandler {
-	var store *storage.Store
-	var err error
+// Stop answering snapshot requests and publishing rules.
+func (self *RuleService) Close() error {
+	self.snapshot.Close()
+	return self.serve.Close()
+}
+
+// Answer requests for the latest rules.
+func (self *RuleService) serveSnapshots() {
+	for {
+		_, err := self.snapshot.Accept(self.handleSnapshot)
+		if err == mangos.ErrClosed {
+			return
+		} else if err != nil {
+			fmt.Println("Error answering snapshot request", err)
+		}
+	}
+}
+
+// Handle a request for the latest rule for every dataset and direction.
+func (self *RuleService) handleSnapshot(request []byte) []byte {
+	decoded, err := protocol.DecodeRequest(request)
+	if err != nil {
+		fmt.Println("Failed to decode")
+		fmt.Println(err.Error())
+		return decoded.Reply(protocol.DecodeErrorResponse(err))
+	}
+
+	name := decoded.Name
+	switch decoded.Value.(type) {
+	case protocol.Hello:
+		return decoded.Reply(protocol.NewResponse(protocol.ServerHello()))
+	case protocol.SnapshotRequest:
+		if !self.acl.CanRead(decoded.Token) {
+			return decoded.Reply(protocol.ErrorResponse(protocol.Forbidden, "Unknown token"))
+		}
+	default:
+		fmt.Println("Unknown request type")
+		fmt.Println(name)
+		return decoded.Reply(protocol.ErrorResponse(protocol.UnknownRequest, "Unknown request type "+name))
+	}
+
+	return decoded.Reply(protocol.NewResponse(self.Snapshot()))
+}
+
+// The latest rule sent for every dataset and direction, sorted by name.
+func (self *RuleService) Snapshot() protocol.RuleSnapshot {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	names := make([]string, 0, len(self.latest))
+	for name := range self.latest {
+		names = append(names, name)
+	}
+	sort.Strings(names)
 
+	snapshot := protocol.RuleSnapshot{}
+	for _, name := range names {
+		snapshot.Rules = append(snapshot.Rules, *self.latest[name])
+	}
+
+	return snapshot
+}
+
+// Get a copy of every rule that is sent from now on, until Unwatch is called.  Rules are dropped
+// if the watcher falls too far behind.
+func (self *RuleService) Watch() chan protocol.Rule {
+	watcher := make(chan protocol.Rule, watcherQueueLength)
+
+	self.lock.Lock()
+	self.watchers[watcher] = true
+	self.lock.Unlock()
+
+	return watcher
+}
+
+// Stop sending rules to a channel from Watch.
+func (self *RuleService) Unwatch(watcher chan protocol.Rule) {
+	self.lock.Lock()
+	delete(self.watchers, watcher)
+	self.lock.Unlock()
+}
+
+// Send a rule to the subscribers and watchers, and remember it for the snapshots.
+func (self *RuleService) publish(name string, rule *protocol.Rule) {
+	self.lock.Lock()
+	self.latest[name] = rule
+	for watcher := range self.watchers {
+		select {
+		case watcher <- *rule:
+		default:
+		}
+	}
+	self.lock.Unlock()
+
+	sendRule(self.source, rule)
+}
+
+// The latest rule that was sent for the dataset (i.e. "dataset1-incoming"), or nil if there
+// hasn't been one yet.
+func (self *RuleService) Latest(name string) *protocol.Rule {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.latest[name]
+}
+
+// Return the rule handler for the dataset (i.e. "dataset1-incoming"), creating one that uses the
+// store that recorded the offset/subsequence combinations if needed.
+func (self RuleHandlers) Load(name string) *RuleHandler {
 	if handler, ok := self.handlers[name]; ok {
 		return handler
 	} else {
-		// Add the files (index and source) that record the offset/subsequence combinations
-		// to the storeCache.
-		// Behavior isn't quite correct here, as there will be undesired
-		// "dataset1-incoming-offsets-sequence-offsets-sequence" stores created.
-		store = self.storeCache.Get(name + "-offsets-sequence")
-		if store == nil {
-			store, err = storage.OpenStore(name + "-offsets-sequence")
-			if err != nil {
-				fmt.Println("Error opening store")
-				fmt.Println(err)
-				return nil
-			}
-
-			// This overrides the stores.
-			// Now "dataset1-incoming"->the store containing the rule candidates
-			// Now "dataset1-incoming-offsets-sequence"->a store containing nothing
-			self.storeCache.Put(name, store)
+		// Get the files (index and source) that record the offset/subsequence combinations
+		// from the storeCache. This is the same store the training service adds sequences to.
+		store, err := self.storeCache.Open(name + "-offsets-sequence")
+		if err != nil {
+			fmt.Println("Error opening store")
+			fmt.Println(err)
+			return nil
 		}
 
 		//		fmt.Println("New rule store", store)
 		// path is "dataset1-incoming", the store contains the rule candidates now rather than the
 		// original training packet payloads.
 		handler := &RuleHandler{path: name, store: store, cachedRule: nil}
+		handler.restore(self.storeCache.Root)
 		self.handlers[name] = handler
 
 		return handler
 	}
 }
 
-// Put the rule to send on the PubsubSource channel by converting it to bytes.
-func sendRule(source protocol.PubsubSource, rule *protocol.Rule) {
-	var value = protocol.NamedType{Name: "protocol.Rule", Value: rule}
+// Start from the best rule candidate that was saved before the last shutdown, if there is one,
+// so that it can be published before any new training packets arrive.
+func (self *RuleHandler) restore(root *storage.Root) {
+	config, err := storage.LoadDatasetConfig(root, self.path)
+	if err != nil {
+		fmt.Println("Error loading dataset config", err)
+		return
+	}
 
-	var buff = new(bytes.Buffer)
-	var bw = bufio.NewWriter(buff)
-	var h codec.Handle = protocol.NamedTypeHandle()
+	scorer, err := storage.NewScorer(config)
+	if err != nil {
+		fmt.Println("Error loading dataset config", err)
+		return
+	}
 
-	var enc *codec.Encoder = codec.NewEncoder(bw, h)
-	var err error = enc.Encode(value)
+	candidates, err := storage.LoadTopCandidates(root, self.path+"-offsets-sequence", scorer)
 	if err != nil {
-		fmt.Printf("Error encoding packet: %s", err.Error())
+		fmt.Println("Error loading saved rules", err)
 		return
 	}
 
-	bw.Flush()
+	if len(candidates) > 0 {
+		self.cachedRule = candidates[0]
+	}
+}
+
+// Put the rule to send on the PubsubSource channel by converting it to bytes.  Subscribers can't
+// say which version they understand, so rules are sent in the oldest version that is supported.
+func sendRule(source protocol.PubsubSource, rule *protocol.Rule) {
+	data, err := protocol.EncodeVersion("protocol.Rule", rule, "", protocol.MinProtocolVersion)
+	if err != nil {
+		fmt.Printf("Error encoding packet: %s", err.Error())
+		return
+	}
 
-	source <- buff.Bytes()
+	// Subscribers filter on the topic in front of the encoded rule.
+	source <- append(protocol.RuleTopic(rule.Dataset, rule.Incoming), data...)
 }
 
 // go routine that reads from the incoming best rule candidate update channel.
 func (self *RuleService) handleUpdates() {
+	// Publish the rules that were restored when the handlers were loaded.
+	for name, handler := range self.handlers.handlers {
+		if handler.cachedRule != nil {
+			result := handler.Handle(name, Update{Path: name, Rule: handler.cachedRule})
+			if result != nil {
+				fmt.Println("Sending saved rule", name, len(result.Sequence), result)
+				self.publish(name, result)
+			}
+		}
+	}
+
 	// iterate through the incoming best rule candidate updates that are generated by
 	// processing training packets.
 	for update := range self.updates {
@@ -129,11 +267,11 @@ func (self *RuleService) handleUpdates() {
 		name := update.Path 		// i.e. "dataset1-incoming"
 		handler := self.handlers.Load(name)
 		if handler != nil {
-			result := handler.Handle(name, update.Rule)
+			result := handler.Handle(name, update)
 			if result != nil {
 				fmt.Println("Sending rule", name, len(result.Sequence), result)
 				fmt.Print("!")
-				sendRule(self.source, result)
+				self.publish(name, result)
 			}
 		} else {
 			fmt.Println("Could not load handler for", name)
@@ -141,10 +279,25 @@ func (self *RuleService) handleUpdates() {
 	}
 }
 
-// Process a best rule candidate from the updates channel. name is something like "dataset1-incoming".
+// Process an update from the updates channel. name is something like "dataset1-incoming".
+// The update has either a best rule candidate or the prefixes extracted from the bytemaps, so
+// the latest of each is kept and both are sent together.
 // Get a Rule struct that packages the rule slightly differently.
-func (self *RuleHandler) Handle(name string, cn *storage.RuleCandidate) *protocol.Rule {
-	self.cachedRule = cn
+func (self *RuleHandler) Handle(name string, update Update) *protocol.Rule {
+	if update.Rule != nil {
+		self.cachedRule = update.Rule
+	} else {
+		self.allowPrefix = update.AllowPrefix
+		self.blockPrefix = update.BlockPrefix
+	}
+
+	// The prefixes can arrive before there is a best rule candidate.
+	if self.cachedRule == nil {
+		dataset, incoming, _ := splitDatasetName(name)	// get just "dataset1" and true
+		return &protocol.Rule{Dataset: dataset, Incoming: incoming, AllowPrefix: self.allowPrefix, BlockPrefix: self.blockPrefix}
+	}
+
+	cn := self.cachedRule
 	index := cn.Index
 	//	fmt.Println("Handle", self.store)
 	storage.Debug = true
@@ -157,8 +310,27 @@ func (self *RuleHandler) Handle(name string, cn *storage.RuleCandidate) *protoco
 
 	fmt.Println("Rule record:", record)
 
-	sequence := record.Data			// the sequence is really the offset and byte subsequence concatenated
-	parts := strings.Split(name, "-")	// get just ["dataset1", "incoming"]
+	rule := ruleFromCandidate(name, cn, record.Data)
+	rule.AllowPrefix = self.allowPrefix
+	rule.BlockPrefix = self.blockPrefix
 
-	return &protocol.Rule{Dataset: parts[0], RequireForbid: cn.RequireForbid(), Incoming: parts[1] == "incoming", Sequence: sequence}
+	return &rule
+}
+
+// Package a rule candidate for the dataset name (i.e. "dataset1-incoming") as a Rule.  The sequence
+// is the offset and byte subsequence concatenated, from the offsets-sequence store.
+func ruleFromCandidate(name string, cn *storage.RuleCandidate, sequence []byte) protocol.Rule {
+	dataset, incoming, _ := splitDatasetName(name)	// get just "dataset1" and true
+
+	return protocol.Rule{
+		Dataset:       dataset,
+		RequireForbid: cn.RequireForbid(),
+		Incoming:      incoming,
+		Sequence:      sequence,
+		Score:         cn.Score(),
+		AllowCount:    cn.AllowCount,
+		AllowTotal:    cn.AllowTotal,
+		BlockCount:    cn.BlockCount,
+		BlockTotal:    cn.BlockTotal,
+	}
 }
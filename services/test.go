@@ -0,0 +1,145 @@
+package services
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/OperatorFoundation/AdversaryLab/protocol"
+	"github.com/go-mangos/mangos"
+)
+
+// The test service checks the rules against held-out traffic.  Each test packet is classified
+// with the latest rule sent for its dataset and direction, and the decisions are counted so that
+// the rules can be measured on traffic they weren't trained on.  The counts are kept in memory,
+// so they start over when the server is restarted.
+type TestService struct {
+	serve protocol.Server                // contains the socket for listening for test packets
+	rules *RuleService                   // where the latest rules come from
+	stats map[string]*protocol.TestStats // keys are i.e. "dataset1-incoming"
+	acl   *ACL                           // test packets need the same permission as training packets, nil to allow everyone
+	lock  sync.Mutex                     // for stats, which the HTTP service reads
+}
+
+// The server side that receives test packets
+// Listen address is set up to be tcp://localhost:4569
+func NewTestPacketService(listenAddress string, rules *RuleService, options protocol.Options, acl *ACL) *TestService {
+	serve := protocol.Listen(listenAddress, options)
+
+	return &TestService{serve: serve, rules: rules, stats: make(map[string]*protocol.TestStats), acl: acl}
+}
+
+// Goroutine spawned by the AdversaryLab/server.go that listens for and handles test packets.
+func (self *TestService) Run() {
+	for {
+		_, err := self.serve.Accept(self.Handle)
+		if err == mangos.ErrClosed {
+			return
+		} else if err != nil {
+			fmt.Println("Error answering test request", err)
+		}
+	}
+}
+
+// Stop taking test packets.  Run returns once its socket is closed.
+func (self *TestService) Close() error {
+	return self.serve.Close()
+}
+
+// Handles a test packet or a request for the counts.
+func (self *TestService) Handle(request []byte) []byte {
+	decoded, err := protocol.DecodeRequest(request)
+	if err != nil {
+		fmt.Println("Failed to decode")
+		fmt.Println(err.Error())
+		return decoded.Reply(protocol.DecodeErrorResponse(err))
+	}
+
+	name := decoded.Name
+	switch value := decoded.Value.(type) {
+	case protocol.Hello:
+		return decoded.Reply(protocol.NewResponse(protocol.ServerHello()))
+	case protocol.TestPacket:
+		if !self.acl.CanWrite(decoded.Token, value.Dataset) {
+			return decoded.Reply(protocol.ErrorResponse(protocol.Forbidden, "Not allowed to test on "+value.Dataset))
+		}
+
+		if len(value.Payload) == 0 {
+			return decoded.Reply(protocol.ErrorResponse(protocol.InvalidRequest, "Test packet has no payload"))
+		}
+
+		result := self.test(value)
+		self.lock.Lock()
+		self.get(value.Dataset, value.Incoming).Add(result, value.AllowBlock)
+		self.lock.Unlock()
+		return decoded.Reply(protocol.NewResponse(result))
+	case protocol.TestStatsRequest:
+		if !self.acl.CanRead(decoded.Token) {
+			return decoded.Reply(protocol.ErrorResponse(protocol.Forbidden, "Unknown token"))
+		}
+
+		return decoded.Reply(protocol.NewResponse(self.Stats(value.Dataset, value.Incoming)))
+	default:
+		fmt.Println("Unknown request type")
+		fmt.Println(name)
+		return decoded.Reply(protocol.ErrorResponse(protocol.UnknownRequest, "Unknown request type "+name))
+	}
+}
+
+// Classify a test packet with the latest rule for its dataset and direction.  Rules that only
+// have the bytemap prefixes can't be tested yet.
+func (self *TestService) test(packet protocol.TestPacket) protocol.TestResult {
+	result := protocol.TestResult{Dataset: packet.Dataset, Incoming: packet.Incoming}
+
+	rule := self.rules.Latest(datasetName(packet.Dataset, packet.Incoming))
+	if rule == nil || len(rule.Subsequence()) == 0 {
+		return result
+	}
+
+	result.Tested = true
+	result.Blocked = rule.Blocks(packet.Payload)
+	result.Correct = result.Blocked != packet.AllowBlock
+	return result
+}
+
+// The counts for a dataset and direction so far.
+func (self *TestService) Stats(dataset string, incoming bool) protocol.TestStats {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return *self.get(dataset, incoming)
+}
+
+// Return the counts for a dataset and direction, starting them if needed.  The caller holds the
+// lock.
+func (self *TestService) get(dataset string, incoming bool) *protocol.TestStats {
+	name := datasetName(dataset, incoming)
+	if stats, ok := self.stats[name]; ok {
+		return stats
+	}
+
+	stats := &protocol.TestStats{Dataset: dataset, Incoming: incoming}
+	self.stats[name] = stats
+	return stats
+}
+
+// The name of the store for a dataset and direction, i.e. "dataset1-incoming".
+func datasetName(dataset string, incoming bool) string {
+	if incoming {
+		return dataset + "-incoming"
+	}
+
+	return dataset + "-outgoing"
+}
+
+// Split the name of a store (i.e. "my-set-incoming") into the dataset and direction.  Dataset
+// names can have "-" in them, so the direction is what follows the last one.  ok is false if the
+// name has no direction.
+func splitDatasetName(name string) (dataset string, incoming bool, ok bool) {
+	index := strings.LastIndex(name, "-")
+	if index < 0 {
+		return name, false, false
+	}
+
+	return name[:index], name[index+1:] == "incoming", true
+}
@@ -1,18 +1,35 @@
 package services
 
 import (
+	"bytes"
 	"fmt"
-
-	"github.com/ugorji/go/codec"
+	"sync"
+	"time"
 
 	"github.com/OperatorFoundation/AdversaryLab/protocol"
 	"github.com/OperatorFoundation/AdversaryLab/storage"
+	"github.com/go-mangos/mangos"
+)
+
+// Rewriting the bytemaps is slow compared to flushing the countmap, so they are saved less often.
+const bytemapSaveInterval = 30 * time.Second
+
+// Each dataset queues this many training packets while earlier ones are processed.  When a queue
+// is full, a request waits up to queueWait in all for room, and the packets that don't fit by then
+// are answered with protocol.Busy.
+const (
+	queueLength = 1024
+	queueWait   = time.Second
 )
 
 type Handlers struct {
 	handlers   map[string]*StoreHandler // keys are i.e. "dateset1-incoming"
 	updates    chan Update              // channel of best rule candidates
 	storeCache *storage.StoreCache      // map of all stores for received data (not sequences)
+	loading    map[string]chan struct{} // datasets being opened, closed once they have been
+	lock       *sync.Mutex              // for handlers and loading, which the request and ingestion sockets both use
+	acl        *ACL                     // which tokens can train on which datasets, nil to allow everyone
+	rules      *RuleService             // has the latest prefixes for the rules that are asked for, nil if there isn't one
 }
 
 // StoreHandler is a request handler that knows about storage
@@ -23,93 +40,217 @@ type StoreHandler struct {
 	offseqs       *storage.OffsetSequenceMap  // struct containing store with sequence files, ctrie, best rule, update channel
 	updates       chan Update                 // channel of best rule updates ("dataset1-incoming' + best rule candidate)
 	ruleUpdates   chan *storage.RuleCandidate // channel of best rule candidates
-	handleChannel chan *protocol.TrainPacket  // channel of decoded training packets; these get added to the store and processed
+	handleChannel chan *trainRequest          // channel of decoded training packets; these get added to the store and processed
+	ingestChannel chan *trainRequest          // training packets from the ingestion socket, waiting for room in handleChannel
+	allow         *storage.Bytemap            // byte transition counts of allowed payloads
+	block         *storage.Bytemap            // byte transition counts of blocked payloads
+	allowPrefix   []byte                      // last published prefix extracted from the allow bytemap
+	blockPrefix   []byte                      // last published prefix extracted from the block bytemap
+	bytemapsSaved time.Time                   // when the bytemaps were last saved
+	stopped       chan struct{}               // closed once handleChannel has been closed and the counts flushed
 }
 
 type TrainService struct {
 	handlers Handlers
-	serve    protocol.Server // contains the socket for listening for training packets
+	serve    protocol.Server        // contains the socket for listening for training packets
+	ingest   *protocol.IngestServer // socket that training packets are streamed to without replies, nil if it isn't open
 }
 
+// A decoded training packet and the channel to send the index it was stored at on, so that it
+// can be sent back to the client.
+type trainRequest struct {
+	packet *protocol.TrainPacket
+	index  chan int64 // gets the record index, or -1 if the packet couldn't be stored; nil if nobody is waiting
+}
+
+// An update is either a new best rule candidate or, when Rule is nil, new prefixes extracted
+// from the bytemaps.
 type Update struct {
-	Path string
-	Rule *storage.RuleCandidate
+	Path        string
+	Rule        *storage.RuleCandidate
+	AllowPrefix []byte
+	BlockPrefix []byte
 }
 
 // The server side that receives training packets
 // Listen address is set up to be tcp://localhost:4567
-func NewTrainPacketService(listenAddress string, updates chan Update, storeCache *storage.StoreCache) *TrainService {
-	handlers := Handlers{handlers: make(map[string]*StoreHandler), updates: updates, storeCache: storeCache}
-	// files, err := ioutil.ReadDir("store")
-	// if err != nil {
-	// 	fmt.Println("Failed to read store directory", err)
-	// } else {
-	// 	for _, file := range files {
-	// 		handlers.Load(file.Name())
-	// 	}
-	// }
+// Ingest address is set up to be tcp://localhost:4571, or "" to only take training packets on
+// the listen address.
+// rules is the rule service that the updates go to, which has the prefixes for rule queries.
+// options has the certificates for "tls+tcp://" addresses, and acl is who can train on what, or
+// nil to let anyone who can connect train on any dataset.
+func NewTrainPacketService(listenAddress string, ingestAddress string, updates chan Update, rules *RuleService, storeCache *storage.StoreCache, options protocol.Options, acl *ACL) *TrainService {
+	handlers := Handlers{handlers: make(map[string]*StoreHandler), loading: make(map[string]chan struct{}), updates: updates, storeCache: storeCache, lock: new(sync.Mutex), acl: acl, rules: rules}
+	// Load every dataset that is already in storage so that records that were stored
+	// but not processed before the last shutdown are replayed.
+	names, err := storeCache.Root.ListDatasets()
+	if err != nil {
+		fmt.Println("Failed to read store directory", err)
+	} else {
+		for _, name := range names {
+			handlers.Load(name)
+		}
+	}
 
 	// Sets up the socket for listening for training packets
-	serve := protocol.Listen(listenAddress)
+	serve := protocol.Listen(listenAddress, options)
+
+	service := &TrainService{handlers: handlers, serve: serve}
+	if ingestAddress != "" {
+		ingest, err := protocol.NewIngestServer(ingestAddress, options)
+		if err != nil {
+			fmt.Println("Error opening ingestion socket", err)
+		} else {
+			service.ingest = &ingest
+		}
+	}
 
-	return &TrainService{handlers: handlers, serve: serve}
+	return service
 }
 
 // Goroutine spawned by the AdversaryLab/server.go that listens for and handles training packets.
 func (self *TrainService) Run() {
-	// Continuously accept training packets.
+	if self.ingest != nil {
+		go self.ingest.Pump(self.handlers.Ingest)
+	}
+
+	// Continuously accept training packets until the service is closed.
 	for {
 		//		fmt.Println("accepting reqresp")
-		self.serve.Accept(self.handlers.Handle)
+		_, err := self.serve.Accept(self.handlers.Handle)
+		if err == mangos.ErrClosed {
+			return
+		} else if err != nil {
+			fmt.Println("Error answering training request", err)
+		}
 		//		fmt.Println("accepted reqresp")
 	}
 }
 
-// Return the corresponding store handler if it already exists, otherwise create one.
-func (self Handlers) Load(name string) *StoreHandler {
-	var err error
+// Stop taking training packets.  Run returns once its socket is closed.
+func (self *TrainService) Close() error {
+	if self.ingest != nil {
+		self.ingest.Close()
+	}
 
-	if handler, ok := self.handlers[name]; ok {
-		return handler
-	} else {
-		store := self.storeCache.Get(name)
-		// If the desired store (i.e. dataset1-incoming) doesn't already exist,
-		// create a store for it and store it in the storeCache.
-		if store == nil {
-			store, err = storage.OpenStore(name)
-			if err != nil {
-				fmt.Println("Error opening store")
-				fmt.Println(err)
-				return nil
-			}
+	return self.serve.Close()
+}
+
+// Return the corresponding store handler if it already exists, otherwise create one.  Opening a
+// dataset is slow, so it's done without holding the lock, and anyone else who asks for the same
+// dataset meanwhile waits for it to be opened instead of opening it again.
+func (self Handlers) Load(name string) *StoreHandler {
+	self.lock.Lock()
+	for {
+		if handler, ok := self.handlers[name]; ok {
+			self.lock.Unlock()
+			return handler
+		}
 
-			self.storeCache.Put(name, store)
+		loading, ok := self.loading[name]
+		if !ok {
+			break
 		}
 
-		// sm, err2 := storage.NewSequenceMap(name)
-		// if err2 != nil {
-		// 	fmt.Println("Error opening bytemap")
-		// 	fmt.Println(err2)
-		// 	return nil
-		// }
+		// Look again once it has been opened, in case opening it failed.
+		self.lock.Unlock()
+		<-loading
+		self.lock.Lock()
+	}
+
+	loading := make(chan struct{})
+	self.loading[name] = loading
+	self.lock.Unlock()
+
+	handler := self.open(name)
+
+	self.lock.Lock()
+	delete(self.loading, name)
+	close(loading)
+	if handler != nil {
+		self.handlers[name] = handler
+	}
+	self.lock.Unlock()
+
+	if handler != nil {
+		handler.Init()
+	}
+
+	return handler
+}
+
+// Open the store, countmap and bytemaps for a dataset (i.e. "dataset1-incoming").  Returns nil if
+// any of them can't be opened.
+func (self Handlers) open(name string) *StoreHandler {
+	// If the desired store (i.e. dataset1-incoming) doesn't already exist,
+	// create a store for it and store it in the storeCache.
+	store, err := self.storeCache.Open(name)
+	if err != nil {
+		fmt.Println("Error opening store")
+		fmt.Println(err)
+		return nil
+	}
+
+	// sm, err2 := storage.NewSequenceMap(name)
+	// if err2 != nil {
+	// 	fmt.Println("Error opening bytemap")
+	// 	fmt.Println(err2)
+	// 	return nil
+	// }
 
-		// Channel for passing best rule candidate updates.
-		ruleUpdates := make(chan *storage.RuleCandidate, 10)
+	// Channel for passing best rule candidate updates.
+	ruleUpdates := make(chan *storage.RuleCandidate, 10)
 
-		osm, err2 := storage.NewOffsetSequenceMap(name, ruleUpdates)
-		if err2 != nil {
-			fmt.Println("Error opening bytemap")
-			fmt.Println(err2)
+	config, err2 := storage.LoadDatasetConfig(self.storeCache.Root, name)
+	if err2 != nil {
+		fmt.Println("Error loading dataset config")
+		fmt.Println(err2)
+		return nil
+	}
+
+	osm, err3 := storage.NewOffsetSequenceMap(self.storeCache, name, ruleUpdates, config)
+	if err3 != nil {
+		fmt.Println("Error opening bytemap")
+		fmt.Println(err3)
+		return nil
+	}
+
+	// Stores that were checkpointed before the countmap kept its own checkpoint.
+	if osm.Last() < 0 {
+		data, err4 := storage.LoadStoreData(self.storeCache.Root, name)
+		if err4 != nil {
+			fmt.Println("Error loading derived data")
+			fmt.Println(err4)
 			return nil
 		}
 
-		handleChannel := make(chan *protocol.TrainPacket)
+		if data.Last >= 0 {
+			osm.Checkpoint(data.Last)
+			osm.Flush()
+		}
+	}
 
-		handler := &StoreHandler{path: name, store: store, offseqs: osm, updates: self.updates, ruleUpdates: ruleUpdates, handleChannel: handleChannel}
-		handler.Init()
-		self.handlers[name] = handler
-		return handler
+	allow, err5 := storage.NewBytemapFile(self.storeCache.Root, name, "bytemap-allow")
+	if err5 != nil {
+		fmt.Println("Error opening bytemap")
+		fmt.Println(err5)
+		return nil
+	}
+
+	block, err6 := storage.NewBytemapFile(self.storeCache.Root, name, "bytemap-block")
+	if err6 != nil {
+		fmt.Println("Error opening bytemap")
+		fmt.Println(err6)
+		return nil
 	}
+
+	handleChannel := make(chan *trainRequest, queueLength)
+	ingestChannel := make(chan *trainRequest, queueLength)
+
+	handler := &StoreHandler{path: name, store: store, offseqs: osm, updates: self.updates, ruleUpdates: ruleUpdates, handleChannel: handleChannel, ingestChannel: ingestChannel, allow: allow, block: block, bytemapsSaved: time.Now(), stopped: make(chan struct{})}
+	handler.allowPrefix = allow.Extract()
+	handler.blockPrefix = block.Extract()
+	return handler
 }
 
 // Handles a new training packet on the server side.  This function is called on packets that
@@ -118,62 +259,314 @@ func (self Handlers) Handle(request []byte) []byte {
 	//	fmt.Println("New packet")
 	var name string
 
-	var value = protocol.NamedType{}
-	var h = protocol.NamedTypeHandle()
-	var dec = codec.NewDecoderBytes(request, h)
-	var err = dec.Decode(&value)
+	decoded, err := protocol.DecodeRequest(request)
 	if err != nil {
 		fmt.Println("Failed to decode")
 		fmt.Println(err.Error())
-		return []byte("success")
+		return decoded.Reply(protocol.DecodeErrorResponse(err))
 	}
 
-	switch value.Name {
-	case "protocol.TrainPacket":
+	messageName, value, token := decoded.Name, decoded.Value, decoded.Token
+
+	// Anyone can ask which versions are supported, but only known tokens can look at the rules.
+	switch value.(type) {
+	case protocol.Hello, protocol.TrainPacket, protocol.TrainBatch:
+	default:
+		if !self.acl.CanRead(token) {
+			return decoded.Reply(protocol.ErrorResponse(protocol.Forbidden, "Unknown token"))
+		}
+	}
+
+	switch value := value.(type) {
+	case protocol.Hello:
+		return decoded.Reply(protocol.NewResponse(protocol.ServerHello()))
+	case protocol.TrainPacket:
 		//		fmt.Println("Got packet")
-		packet := protocol.TrainPacketFromMap(value.Value.(map[interface{}]interface{}))
+		indices, response := self.train([]protocol.TrainPacket{value}, token)
+		response.Index = indices[0]
+		return decoded.Reply(response)
+	case protocol.TrainBatch:
+		// The batch is acknowledged as a whole, with the index of each packet.
+		indices, response := self.train(value.Packets, token)
+		response.Value = indices
+		return decoded.Reply(response)
+	case protocol.RuleRequest:
+		request := value
+		if request.Incoming {
+			name = request.Dataset + "-incoming"
+		} else {
+			name = request.Dataset + "-outgoing"
+		}
+
+		// The response has no value if there isn't a rule yet.
+		response := protocol.NewResponse(nil)
+		if rules := self.topRules(name); len(rules) > 0 {
+			response.Value = rules[0]
+		}
+
+		return decoded.Reply(response)
+	case protocol.TopRulesRequest:
+		request := value
+		if request.Incoming {
+			name = request.Dataset + "-incoming"
+		} else {
+			name = request.Dataset + "-outgoing"
+		}
+
+		top := protocol.TopRules{Dataset: request.Dataset, Incoming: request.Incoming, Rules: self.topRules(name)}
+
+		return decoded.Reply(protocol.NewResponse(top))
+	default:
+		fmt.Println("Unknown request type")
+		fmt.Println(value)
+		fmt.Println("<.>")
+		return decoded.Reply(protocol.ErrorResponse(protocol.UnknownRequest, "Unknown request type "+messageName))
+	}
+}
+
+// Pass training packets to the handlers for their datasets and wait until they have been stored.
+// Packets for different datasets are stored in parallel, and each handler stores its packets in
+// the order they were sent.  Packets for datasets the token can't train on aren't stored.
+// Returns the index each packet was stored at, -1 for the ones that weren't, and a Response that
+// says why the first of those failed.
+func (self Handlers) train(packets []protocol.TrainPacket, token string) ([]int64, protocol.Response) {
+	var name string
+
+	response := protocol.NewResponse(nil)
+	fail := func(status protocol.ResultStatus, message string) {
+		if response.Status == protocol.Success {
+			response = protocol.ErrorResponse(status, message)
+		}
+	}
+
+	// One deadline for the whole request, so a batch for a busy dataset doesn't wait for each packet.
+	deadline := time.NewTimer(queueWait)
+	defer deadline.Stop()
+	expired := false
+
+	indices := make([]int64, len(packets))
+	results := make([]chan int64, len(packets))
+	for i := range packets {
+		packet := &packets[i]
+		indices[i] = -1
+
 		if packet.Incoming {
 			name = packet.Dataset + "-incoming"
 		} else {
 			name = packet.Dataset + "-outgoing"
 		}
 
+		if !self.acl.CanWrite(token, packet.Dataset) {
+			fail(protocol.Forbidden, "Not allowed to train on "+packet.Dataset)
+			continue
+		}
+
+		if len(packet.Payload) == 0 {
+			fail(protocol.InvalidRequest, "Training packet has no payload")
+			continue
+		}
+
 		// Get the handler for packets of this dataset-incoming/outgoing and pass the training
 		// packet onto the handler's channel.
 		handler := self.Load(name)
-		if handler != nil {
-			handler.handleChannel <- &packet
-			return []byte("success")
-		} else {
+		if handler == nil {
 			fmt.Println("Could not load handler for", name)
-			return []byte("success")
+			fail(protocol.DatasetFailed, "Could not load dataset "+name)
+			continue
+		}
+
+		// Only wait a little while for room in the queue, so that one busy dataset doesn't hold
+		// up the requests for the others.  Once the deadline has passed, packets are only queued
+		// if there's room right away.
+		result := make(chan int64, 1)
+		request := &trainRequest{packet: packet, index: result}
+		if expired {
+			select {
+			case handler.handleChannel <- request:
+				results[i] = result
+			default:
+				fail(protocol.Busy, "Queue for "+name+" is full")
+			}
+		} else {
+			select {
+			case handler.handleChannel <- request:
+				results[i] = result
+			case <-deadline.C:
+				expired = true
+				fail(protocol.Busy, "Queue for "+name+" is full")
+			}
+		}
+	}
+
+	for i, result := range results {
+		if result == nil {
+			continue
+		}
+
+		indices[i] = <-result
+		if indices[i] < 0 {
+			fail(protocol.StoreFailed, "Could not store training packet for "+packets[i].Dataset)
 		}
+	}
+
+	return indices, response
+}
+
+// Handles a message from the ingestion socket, which is a training packet or a batch of them.
+// Each packet goes to the ingestion queue for its dataset, which is emptied into the dataset's
+// training queue by its own goroutine, so a busy dataset doesn't hold up the packets already
+// queued for the others.  When a dataset's ingestion queue is full this waits for room, which
+// leaves the messages behind it on the socket until the senders get protocol.ErrBusy.
+func (self Handlers) Ingest(message []byte) {
+	var name string
+
+	decoded, err := protocol.DecodeRequest(message)
+	if err != nil {
+		fmt.Println("Failed to decode")
+		fmt.Println(err.Error())
+		return
+	}
+
+	var packets []protocol.TrainPacket
+	switch value := decoded.Value.(type) {
+	case protocol.TrainPacket:
+		packets = append(packets, value)
+	case protocol.TrainBatch:
+		packets = value.Packets
 	default:
-		fmt.Println("Unknown request type")
+		fmt.Println("Unknown ingestion type")
 		fmt.Println(value)
-		fmt.Println("<.>")
-		return []byte("success")
+		return
+	}
+
+	for i := range packets {
+		packet := &packets[i]
+		if packet.Incoming {
+			name = packet.Dataset + "-incoming"
+		} else {
+			name = packet.Dataset + "-outgoing"
+		}
+
+		if !self.acl.CanWrite(decoded.Token, packet.Dataset) {
+			fmt.Println("Skipping training packet for", name, "from a token that can't train on it")
+			continue
+		}
+
+		if len(packet.Payload) == 0 {
+			fmt.Println("Skipping training packet with no payload for", name)
+			continue
+		}
+
+		handler := self.Load(name)
+		if handler == nil {
+			fmt.Println("Could not load handler for", name)
+			continue
+		}
+
+		handler.ingestChannel <- &trainRequest{packet: packet}
+	}
+}
+
+// Return the store handler for the dataset if it has been loaded, without creating one.
+func (self Handlers) get(name string) *StoreHandler {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	return self.handlers[name]
+}
+
+// The best rules for the dataset (i.e. "dataset1-incoming"), best first, with the prefixes that
+// the rule service has for it so that they match the rules it publishes.  Doesn't create a
+// dataset just because someone asked about it.
+func (self Handlers) topRules(name string) []protocol.Rule {
+	handler := self.get(name)
+	if handler == nil {
+		return nil
 	}
+
+	rules := handler.TopRules()
+	if self.rules != nil {
+		if latest := self.rules.Latest(name); latest != nil {
+			for i := range rules {
+				rules[i].AllowPrefix = latest.AllowPrefix
+				rules[i].BlockPrefix = latest.BlockPrefix
+			}
+		}
+	}
+
+	return rules
 }
 
 // Init process all items that are already in storage
 func (self *StoreHandler) Init() {
-	//	fmt.Println("Loading")
-	// FIXME - loading of Last value
-	//	self.Load()
-	//	fmt.Println("Processing")
-	go self.HandleChannel(self.handleChannel)
 	go self.HandleRuleUpdatesChannel(self.ruleUpdates)
-	//	self.store.FromIndexDo(self.store.LastIndex(), self.processChannel)
+	go self.HandleIngestChannel(self.ingestChannel)
+	// Replay before taking new packets so that records are processed in order.
+	go func() {
+		self.Replay()
+		self.HandleChannel(self.handleChannel)
+	}()
 }
 
-// Handle training packets received on the server that have been decoded.
-func (self *StoreHandler) HandleChannel(ch chan *protocol.TrainPacket) {
-	for request := range ch {
-		if !storage.Debug {
-			fmt.Print(".")
+// Process the records that were added to the store after the last saved checkpoint, such as
+// ones that were stored right before the server was stopped.
+func (self *StoreHandler) Replay() {
+	// Publish what was extracted before the restart, even if there is nothing to replay.
+	if len(self.allowPrefix) > 0 || len(self.blockPrefix) > 0 {
+		self.updates <- Update{Path: self.path, AllowPrefix: self.allowPrefix, BlockPrefix: self.blockPrefix}
+	}
+
+	last := self.last()
+	if last >= self.store.LastIndex() {
+		return
+	}
+
+	fmt.Println("Replaying", self.path, last+1, "->", self.store.LastIndex())
+	self.store.BlockingFromIndexDo(last, func(record *storage.Record) {
+		// Records stored before labels were kept can't be replayed.
+		if record.Meta == nil {
+			fmt.Println("Skipping unlabeled record", self.path, record.Index)
+			self.skip(record.Index)
+			return
 		}
-		self.Handle(request)
+
+		self.Process(record.Meta.AllowBlock, record)
+	})
+
+	self.flush()
+	self.saveBytemaps()
+}
+
+// Handle training packets received on the server that have been decoded.  When no packets
+// arrive for a while, counts that are still only in memory are flushed.
+func (self *StoreHandler) HandleChannel(ch chan *trainRequest) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case request, ok := <-ch:
+			if !ok {
+				self.flush()
+				self.saveBytemaps()
+				close(self.stopped)
+				return
+			}
+			if !storage.Debug {
+				fmt.Print(".")
+			}
+			self.Handle(request)
+		case <-ticker.C:
+			self.flush()
+		}
+	}
+}
+
+// Pass training packets from the ingestion socket on to the training queue, waiting for room.
+// Nobody is waiting for their indices, so there is no deadline like there is for requests.
+func (self *StoreHandler) HandleIngestChannel(ch chan *trainRequest) {
+	for request := range ch {
+		self.handleChannel <- request
 	}
 }
 
@@ -187,34 +580,159 @@ func (self *StoreHandler) HandleRuleUpdatesChannel(ch chan *storage.RuleCandidat
 }
 
 // Handle handles requests (training packets sent from the client).  First adds the payout to the
-// store and then sends the record on to the processor.
-func (self *StoreHandler) Handle(request *protocol.TrainPacket) []byte {
-	// Add the payload (the byte array) to the store (both the source file and index file)
-	index := self.store.Add(request.Payload)
+// store, sends the index back so the client can be answered, and then sends the record on to the
+// processor.
+func (self *StoreHandler) Handle(train *trainRequest) {
+	request := train.packet
+
+	// Packets from older clients don't have a capture time, so use the time they arrived.
+	timestamp := request.Timestamp
+	if timestamp == 0 {
+		timestamp = time.Now().UnixNano()
+	}
+
+	meta := &storage.RecordMeta{AllowBlock: request.AllowBlock, Incoming: request.Incoming, Timestamp: timestamp, Connection: request.Connection}
+
+	// Add the payload (the byte array) and its label to the store (the source, meta and index files)
+	index := self.store.AddRecord(request.Payload, meta)
 	record, err := self.store.GetRecord(index) // checking that record was recorded correctly
 	if err != nil {
 		fmt.Println("Error getting new record", err)
-	} else {
-		self.Process(request.AllowBlock, record)
+		if train.index != nil {
+			train.index <- -1
+		}
+		return
 	}
 
-	return []byte("success")
+	if train.index != nil {
+		train.index <- index
+	}
+	self.Process(request.AllowBlock, record)
 }
 
 // Processes records (training data). Results in rules being put on update channel.
 func (self *StoreHandler) Process(allowBlock bool, record *storage.Record) {
 	//	fmt.Println("Processing", record.Index)
 
-	// For records that haven't been processed yet, they have just been added to the
-	// store, so record.Index should equal self.store.LastIndex().
-	if record.Index < self.store.LastIndex() {
-		fmt.Println("Rejecting duplicate", record.Index, "<", self.store.LastIndex())
+	// Records at or before the checkpoint have already been processed.
+	if record.Index <= self.last() {
+		fmt.Println("Rejecting duplicate", record.Index, "<=", self.last())
+		return
+	}
+
+	// The countmap and the bytemaps are saved at different times, so after a restart one of
+	// them may already have processed the record.
+	if record.Index > self.offseqs.Last() {
+		self.processBytes(allowBlock, record.Data)
+		self.checkpoint(record.Index)
+	}
+
+	self.processBytemaps(allowBlock, record)
+}
+
+// The index of the last record that has been processed by both the countmap and the bytemaps.
+func (self *StoreHandler) last() int64 {
+	last := self.offseqs.Last()
+	if self.allow.GetIndex() < last {
+		last = self.allow.GetIndex()
+	}
+	if self.block.GetIndex() < last {
+		last = self.block.GetIndex()
+	}
+
+	return last
+}
+
+// Mark a record that can't be processed as done.
+func (self *StoreHandler) skip(index int64) {
+	if index > self.offseqs.Last() {
+		self.checkpoint(index)
+	}
+	if index > self.allow.GetIndex() {
+		self.allow.PutIndex(index)
+	}
+	if index > self.block.GetIndex() {
+		self.block.PutIndex(index)
+	}
+}
+
+// Count the byte transitions of the record in the bytemap for its label.  Both bytemaps keep
+// the index of the last record so that they are replayed from the same place.
+func (self *StoreHandler) processBytemaps(allowBlock bool, record *storage.Record) {
+	labeled, other := self.block, self.allow
+	if allowBlock {
+		labeled, other = self.allow, self.block
+	}
+
+	if record.Index > other.GetIndex() {
+		other.PutIndex(record.Index)
+	}
+	if record.Index > labeled.GetIndex() {
+		labeled.ForceProcessBytes(record)
+		self.publishPrefixes()
+	}
+}
+
+// Send the prefixes extracted from the bytemaps to the rule service if they have changed.
+func (self *StoreHandler) publishPrefixes() {
+	allowPrefix := self.allow.Extract()
+	blockPrefix := self.block.Extract()
+	if bytes.Equal(allowPrefix, self.allowPrefix) && bytes.Equal(blockPrefix, self.blockPrefix) {
 		return
 	}
 
-	// FIXME - process bytes into bytemaps
+	self.allowPrefix = allowPrefix
+	self.blockPrefix = blockPrefix
+	self.updates <- Update{Path: self.path, AllowPrefix: allowPrefix, BlockPrefix: blockPrefix}
+}
+
+// The best rules found so far, best first.
+func (self *StoreHandler) TopRules() []protocol.Rule {
+	var rules []protocol.Rule
+	for _, candidate := range self.offseqs.Top() {
+		sequence, err := self.offseqs.Sequence(candidate.Index)
+		if err != nil {
+			fmt.Println("Error getting rule sequence", candidate.Index, err)
+			continue
+		}
+
+		rules = append(rules, ruleFromCandidate(self.path, candidate, sequence))
+	}
+
+	return rules
+}
 
-	self.processBytes(allowBlock, record.Data)
+// Record the index of the last processed record so that a restart resumes after it.  It is
+// saved along with the counts the next time they are flushed.
+func (self *StoreHandler) checkpoint(index int64) {
+	err := self.offseqs.Checkpoint(index)
+	if err != nil {
+		fmt.Println("Error saving countmap", err)
+	}
+}
+
+// Write any counts that are only in memory to disk.  The bytemaps are only saved once
+// bytemapSaveInterval has passed since they were last saved.
+func (self *StoreHandler) flush() {
+	err := self.offseqs.Flush()
+	if err != nil {
+		fmt.Println("Error saving countmap", err)
+	}
+
+	if time.Since(self.bytemapsSaved) >= bytemapSaveInterval {
+		self.saveBytemaps()
+	}
+}
+
+// Write the bytemaps to disk if records were processed since they were last saved.
+func (self *StoreHandler) saveBytemaps() {
+	if self.allow.Pending() {
+		self.allow.Save()
+	}
+	if self.block.Pending() {
+		self.block.Save()
+	}
+	self.bytemapsSaved = time.Now()
 }
 
 // Helper function for processing records (training data).
@@ -2,9 +2,14 @@ package services
 
 import (
 	"bytes"
+	"io/ioutil"
+	"os"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/OperatorFoundation/AdversaryLab/protocol"
+	"github.com/OperatorFoundation/AdversaryLab/storage"
 )
 
 func TestCountmap(t *testing.T) {
@@ -19,27 +24,265 @@ func TestCountmap(t *testing.T) {
 	// for x = 0; x < 10; x++ {
 	for x = 0; x < 127; x++ {
 		buff.WriteByte(byte(x))
-		lab.AddTrainPacket("testing", true, true, buff.Bytes())
+		if _, err := lab.AddTrainPacket("testing", true, true, buff.Bytes()); err != nil {
+			t.Fatal(err)
+		}
 	}
 
 	// Allowed outgoing - 127, ... 127..255
 	buff.Reset()
 	for x = 127; x < 256; x++ {
 		buff.WriteByte(byte(x))
-		lab.AddTrainPacket("testing", true, false, buff.Bytes())
+		if _, err := lab.AddTrainPacket("testing", true, false, buff.Bytes()); err != nil {
+			t.Fatal(err)
+		}
 	}
 
 	// Blocked incoming - 126, ... 126..0
 	buff.Reset()
 	for x = 126; x >= 0; x-- {
 		buff.WriteByte(byte(x))
-		lab.AddTrainPacket("testing", false, true, buff.Bytes())
+		if _, err := lab.AddTrainPacket("testing", false, true, buff.Bytes()); err != nil {
+			t.Fatal(err)
+		}
 	}
 
 	// Blocked outgoing - 255, ... 255..127
 	buff.Reset()
 	for x = 255; x >= 127; x-- {
 		buff.WriteByte(byte(x))
-		lab.AddTrainPacket("testing", false, false, buff.Bytes())
+		if _, err := lab.AddTrainPacket("testing", false, false, buff.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Opens a StoreCache in a new temporary directory so tests don't touch the lab in ./store
+func testStoreCache(t *testing.T) *storage.StoreCache {
+	path, err := ioutil.TempDir("", "adversarylab")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := storage.NewRoot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return storage.NewStoreCache(root)
+}
+
+// Handlers for a test, with the updates thrown away.
+func testHandlers(cache *storage.StoreCache, acl *ACL) Handlers {
+	updates := make(chan Update, 100)
+	go func() {
+		for range updates {
+		}
+	}()
+
+	return Handlers{handlers: make(map[string]*StoreHandler), loading: make(map[string]chan struct{}), updates: updates, storeCache: cache, lock: new(sync.Mutex), acl: acl}
+}
+
+func TestReplay(t *testing.T) {
+	cache := testStoreCache(t)
+	defer os.RemoveAll(cache.Root.Path)
+
+	// Records that were stored but not processed before a restart, one from before labels were kept.
+	store, err := cache.Open("testing-incoming")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Add([]byte("XYZ"))
+	store.AddRecord([]byte("GET"), &storage.RecordMeta{AllowBlock: true, Incoming: true})
+	store.AddRecord([]byte("POST"), &storage.RecordMeta{AllowBlock: false, Incoming: true})
+
+	handler := testHandlers(cache, nil).Load("testing-incoming")
+	if handler == nil {
+		t.Fatal("Could not load handler")
+	}
+
+	// New packets are handled after the replay.
+	for i, payload := range []string{"A", "B"} {
+		index := make(chan int64, 1)
+		handler.handleChannel <- &trainRequest{packet: &protocol.TrainPacket{Dataset: "testing", AllowBlock: true, Incoming: true, Payload: []byte(payload)}, index: index}
+		if <-index != int64(3+i) {
+			t.Fatal("Wrong index for new packet")
+		}
+	}
+
+	// Wait for everything to be processed before looking at the counts.
+	close(handler.handleChannel)
+	<-handler.stopped
+
+	if handler.offseqs.Last() < 3 {
+		t.Error("Replayed records were not checkpointed", handler.offseqs.Last())
+	}
+	if handler.allow.GetCount(0, 0, 'G') != 1 || handler.allow.GetCount(0, 0, 'A') != 1 || handler.block.GetCount(0, 0, 'P') != 1 {
+		t.Error("Labeled records were not replayed")
+	}
+	if handler.allow.GetCount(0, 0, 'X') != 0 || handler.block.GetCount(0, 0, 'X') != 0 {
+		t.Error("Unlabeled record was counted")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	cache := testStoreCache(t)
+	defer os.RemoveAll(cache.Root.Path)
+
+	handlers := testHandlers(cache, nil)
+
+	// A dataset that is taking a long time to open doesn't hold up the others.
+	opened := make(chan struct{})
+	handlers.loading["slow-incoming"] = opened
+
+	waiting := make(chan *StoreHandler)
+	go func() {
+		waiting <- handlers.Load("slow-incoming")
+	}()
+
+	if handlers.get("slow-incoming") != nil || handlers.Load("testing-incoming") == nil {
+		t.Fatal("Could not load a dataset while another was opening")
+	}
+
+	select {
+	case <-waiting:
+		t.Fatal("Loaded a dataset while it was opening")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// Pretend that opening it failed, so the one that was waiting opens it itself.
+	handlers.lock.Lock()
+	delete(handlers.loading, "slow-incoming")
+	close(opened)
+	handlers.lock.Unlock()
+
+	if handler := <-waiting; handler == nil || handler != handlers.get("slow-incoming") {
+		t.Error("Wrong handler after waiting", handler)
+	}
+
+	// Everyone who asks at once gets the same handler.
+	var group sync.WaitGroup
+	loaded := make([]*StoreHandler, 10)
+	for i := range loaded {
+		group.Add(1)
+		go func(i int) {
+			defer group.Done()
+			loaded[i] = handlers.Load("busy-outgoing")
+		}(i)
+	}
+	group.Wait()
+
+	for _, handler := range loaded {
+		if handler == nil || handler != loaded[0] {
+			t.Fatal("Loaded a dataset more than once")
+		}
+	}
+}
+
+func TestTopRulesPrefixes(t *testing.T) {
+	cache := testStoreCache(t)
+	defer os.RemoveAll(cache.Root.Path)
+
+	handlers := testHandlers(cache, nil)
+
+	// Packets are processed in order, so once the last one has been stored the others have been counted.
+	var packets []protocol.TrainPacket
+	for i := 0; i < 4; i++ {
+		packets = append(packets, protocol.TrainPacket{Dataset: "testing", AllowBlock: true, Incoming: true, Payload: []byte("GET /")})
+		packets = append(packets, protocol.TrainPacket{Dataset: "testing", AllowBlock: false, Incoming: true, Payload: []byte("POST /")})
+	}
+	_, response := handlers.train(packets, "")
+	if response.Status != protocol.Success {
+		t.Fatal("Training failed", response)
+	}
+
+	rules := handlers.topRules("testing-incoming")
+	if len(rules) == 0 {
+		t.Fatal("No rules")
+	}
+	if rules[0].Dataset != "testing" || !rules[0].Incoming || rules[0].AllowPrefix != nil {
+		t.Error("Wrong rule", rules[0])
+	}
+
+	// The prefixes come from the rule service, so they match the rules it publishes.
+	handlers.rules = &RuleService{latest: map[string]*protocol.Rule{"testing-incoming": {AllowPrefix: []byte("GET"), BlockPrefix: []byte("POST")}}}
+	for _, rule := range handlers.topRules("testing-incoming") {
+		if string(rule.AllowPrefix) != "GET" || string(rule.BlockPrefix) != "POST" {
+			t.Error("Wrong prefixes", rule)
+		}
+	}
+
+	if handlers.topRules("testing-outgoing") != nil || handlers.get("testing-outgoing") != nil {
+		t.Error("Asking for rules created a dataset")
+	}
+}
+
+func TestTrainBusy(t *testing.T) {
+	cache := testStoreCache(t)
+	defer os.RemoveAll(cache.Root.Path)
+
+	// A dataset whose queue never has room, next to one that works.
+	handlers := testHandlers(cache, nil)
+	stuck := &StoreHandler{path: "stuck-incoming", handleChannel: make(chan *trainRequest), ingestChannel: make(chan *trainRequest, 2)}
+	handlers.handlers["stuck-incoming"] = stuck
+
+	var packets []protocol.TrainPacket
+	for i := 0; i < 3; i++ {
+		packets = append(packets, protocol.TrainPacket{Dataset: "stuck", AllowBlock: true, Incoming: true, Payload: []byte("GET")})
+	}
+	packets = append(packets, protocol.TrainPacket{Dataset: "testing", AllowBlock: true, Incoming: true, Payload: []byte("GET")})
+
+	start := time.Now()
+	indices, response := handlers.train(packets, "")
+	if time.Since(start) >= 2*queueWait {
+		t.Error("Each packet waited for the queue", time.Since(start))
+	}
+	if response.Status != protocol.Busy {
+		t.Error("Wrong status", response)
+	}
+	if indices[0] != -1 || indices[1] != -1 || indices[2] != -1 || indices[3] != 0 {
+		t.Error("Wrong indices", indices)
+	}
+
+	// Streamed packets for the stuck dataset wait in its own ingestion queue without holding up
+	// the others.
+	message, err := protocol.EncodeRequest("protocol.TrainBatch", protocol.TrainBatch{Packets: packets[1:]}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start = time.Now()
+	handlers.Ingest(message)
+	if time.Since(start) >= queueWait {
+		t.Error("Ingest waited for the queue", time.Since(start))
+	}
+	if len(stuck.ingestChannel) != 2 {
+		t.Error("Wrong number of queued packets", len(stuck.ingestChannel))
+	}
+
+	// Once its ingestion queue is full, Ingest waits for room instead of dropping packets, so
+	// the ingestion socket stops reading and the senders are told the lab is busy.
+	message, err = protocol.EncodeRequest("protocol.TrainPacket", packets[0], "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		handlers.Ingest(message)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Ingest dropped a packet for a full queue")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	<-stuck.ingestChannel
+	select {
+	case <-done:
+	case <-time.After(queueWait):
+		t.Error("Ingest didn't queue the packet once there was room")
 	}
 }
@@ -1,51 +1,81 @@
 package main
 
 import (
-	"bytes"
-	"encoding/binary"
 	"encoding/hex"
-	"errors"
+	"flag"
 	"fmt"
-	"os"
 	"strconv"
+	"time"
 
 	"github.com/OperatorFoundation/AdversaryLab/storage"
-
-	"golang.org/x/exp/mmap"
 )
 
 func main() {
 	var store *storage.Store
 	var err error
 
-	if os.Args[1] == "verify" {
-		store, err = storage.OpenStore(os.Args[2])
+	var storePath = flag.String("store", "store", "directory that holds the lab's datasets")
+	flag.Parse()
+	args := flag.Args()
+	root := &storage.Root{Path: *storePath}
+
+	if args[0] == "verify" {
+		store, err = storage.OpenStore(root, args[1])
 		if err != nil {
 			fmt.Println("Error opening store")
 			fmt.Println(err)
 			return
 		}
 		store.Close()
-	} else if os.Args[1] == "add" {
-		store, err = storage.OpenStore(os.Args[2])
+	} else if args[0] == "add" {
+		store, err = storage.OpenStore(root, args[1])
 		if err != nil {
 			fmt.Println("Error opening store")
 			fmt.Println(err)
 			return
 		}
 
-		value := []byte(os.Args[3])
+		value := []byte(args[2])
 		store.Add(value)
 		store.Close()
 
-		store, err = storage.OpenStore(os.Args[2])
+		store, err = storage.OpenStore(root, args[1])
 		if err != nil {
 			fmt.Println("Error opening store")
 			fmt.Println(err)
 			return
 		}
-	} else if os.Args[1] == "rule" {
-		bytemap, err := storage.NewReadonlyBytemap(os.Args[2])
+	} else if args[0] == "records" {
+		// Read-only, so this can be used on a dataset the server is training on.
+		store, err := storage.OpenReadonlyStore(root, args[1])
+		if err != nil {
+			fmt.Println("Error opening store")
+			fmt.Println(err)
+			return
+		}
+
+		// Print what went into the dataset: index, label, direction, capture time, connection and payload.
+		store.BlockingFromIndexDo(-1, func(record *storage.Record) {
+			if record.Meta == nil {
+				fmt.Println(record.Index, "unlabeled", hex.EncodeToString(record.Data))
+				return
+			}
+
+			label := "block"
+			if record.Meta.AllowBlock {
+				label = "allow"
+			}
+			direction := "outgoing"
+			if record.Meta.Incoming {
+				direction = "incoming"
+			}
+			timestamp := time.Unix(0, record.Meta.Timestamp).UTC().Format(time.RFC3339Nano)
+			fmt.Println(record.Index, label, direction, timestamp, record.Meta.Connection, hex.EncodeToString(record.Data))
+		})
+
+		store.Close()
+	} else if args[0] == "rule" {
+		bytemap, err := storage.NewReadonlyBytemap(root, args[1])
 		if err != nil {
 			fmt.Println("Error opening bytemap file", err)
 			return
@@ -53,19 +83,19 @@ func main() {
 		rule := bytemap.Extract()
 		fmt.Println(len(rule))
 		fmt.Println(hex.EncodeToString(rule))
-	} else if os.Args[1] == "bytes" {
-		bytemap, err := storage.NewReadonlyBytemap(os.Args[2])
+	} else if args[0] == "bytes" {
+		bytemap, err := storage.NewReadonlyBytemap(root, args[1])
 		if err != nil {
 			fmt.Println("Error opening bytemap file", err)
 			return
 		}
 		for i := 0; i < 256; i++ {
-			index, err2 := strconv.Atoi(os.Args[3])
+			index, err2 := strconv.Atoi(args[2])
 			if err2 != nil {
 				fmt.Println("Error parsing argument", err)
 				return
 			}
-			prev, err3 := strconv.Atoi(os.Args[4])
+			prev, err3 := strconv.Atoi(args[3])
 			if err3 != nil {
 				fmt.Println("Error parsing argument", err)
 				return
@@ -73,35 +103,35 @@ func main() {
 			fmt.Print(bytemap.GetCount(int(index), byte(prev), byte(i)), " ")
 		}
 		fmt.Println()
-	} else if os.Args[1] == "byte" {
-		bytemap, err := storage.NewReadonlyBytemap(os.Args[2])
+	} else if args[0] == "byte" {
+		bytemap, err := storage.NewReadonlyBytemap(root, args[1])
 		if err != nil {
 			fmt.Println("Error opening bytemap file", err)
 			return
 		}
-		index, err2 := strconv.Atoi(os.Args[3])
+		index, err2 := strconv.Atoi(args[2])
 		if err2 != nil {
 			fmt.Println("Error parsing argument", err2)
 			return
 		}
-		prev, err3 := strconv.Atoi(os.Args[4])
+		prev, err3 := strconv.Atoi(args[3])
 		if err3 != nil {
 			fmt.Println("Error parsing argument", err3)
 			return
 		}
-		next, err4 := strconv.Atoi(os.Args[5])
+		next, err4 := strconv.Atoi(args[4])
 		if err4 != nil {
 			fmt.Println("Error parsing argument", err4)
 			return
 		}
 		fmt.Println(bytemap.GetCount(int(index), byte(prev), byte(next)))
-	} else if os.Args[1] == "bytemap" {
-		bytemap, err := storage.NewBytemap(os.Args[2])
+	} else if args[0] == "bytemap" {
+		bytemap, err := storage.NewBytemap(root, args[1])
 		if err != nil {
 			fmt.Println("Error opening bytemap file", err)
 			return
 		}
-		store, err2 := storage.OpenReadonlyStore(os.Args[2])
+		store, err2 := storage.OpenReadonlyStore(root, args[1])
 		if err2 != nil {
 			fmt.Println("Error opening store")
 			fmt.Println(err2)
@@ -114,14 +144,15 @@ func main() {
 			bytemap.ProcessBytes(record)
 		})
 
+		bytemap.Save()
 		store.Close()
-	} else if os.Args[1] == "forcebytemap" {
-		bytemap, err := storage.NewBytemap(os.Args[2])
+	} else if args[0] == "forcebytemap" {
+		bytemap, err := storage.NewBytemap(root, args[1])
 		if err != nil {
 			fmt.Println("Error opening bytemap file", err)
 			return
 		}
-		store, err2 := storage.OpenReadonlyStore(os.Args[2])
+		store, err2 := storage.OpenReadonlyStore(root, args[1])
 		if err2 != nil {
 			fmt.Println("Error opening store")
 			fmt.Println(err2)
@@ -132,174 +163,7 @@ func main() {
 			bytemap.ForceProcessBytes(record)
 		})
 
+		bytemap.Save()
 		store.Close()
 	}
 }
-
-type Record struct {
-	Index int64
-	Data  []byte
-}
-
-type Store struct {
-	index    *mmap.ReaderAt
-	content  *os.File
-	outindex *os.File
-	output   *os.File
-	last     int64
-}
-
-func (self *Store) Verify() error {
-	var max int64 = int64(self.index.Len()) / (8 * 3)
-
-	if max == 0 {
-		return nil
-	}
-
-	var current int64
-	for current = 0; current < max; current++ {
-		value, err := self.getIndex(current)
-		if err != nil {
-			return err
-		}
-
-		if value != current {
-			fmt.Println("invalid", value, current, max)
-			return errors.New("...Store verification failed: Invalid index " + string(value) + " " + string(current))
-		}
-
-		fmt.Println("Verified", value, current, max)
-	}
-
-	self.last = current
-
-	fmt.Println("Verified store")
-	fmt.Println(self.last)
-
-	return nil
-}
-
-func (self *Store) getIndex(index int64) (int64, error) {
-	return self.getInt64(index * 8 * 3)
-}
-
-func (self *Store) getOffset(index int64) (int64, error) {
-	return self.getInt64((index * 8 * 3) + 8)
-}
-
-func (self *Store) getLength(index int64) (int64, error) {
-	return self.getInt64((index * 8 * 3) + (8 * 2))
-}
-
-func (self *Store) getInt64(index int64) (int64, error) {
-	bs := make([]byte, 8)
-	self.index.ReadAt(bs, index)
-	value, _ := binary.Varint(bs)
-
-	return value, nil
-}
-
-func (self *Store) GetRecord(index int64) (*Record, error) {
-	var offset int64
-	var length int64
-	var err error
-	var bs []byte
-
-	offset, err = self.getOffset(index)
-	if err != nil {
-		return nil, err
-	}
-
-	length, err = self.getLength(index)
-	if err != nil {
-		return nil, err
-	}
-
-	bs = make([]byte, length)
-	_, err = self.content.Seek(offset, 0)
-	if err != nil {
-		return nil, err
-	}
-
-	_, err = self.content.Read(bs)
-	if err != nil {
-		return nil, err
-	}
-
-	return &Record{Index: index, Data: bs}, nil
-}
-
-func (self *Store) LastIndex() int64 {
-	return self.last
-}
-
-func (self *Store) Add(data []byte) int64 {
-	fmt.Println("Adding to store")
-	fmt.Println(self)
-	fmt.Println(self.last)
-	index := self.last + 1
-	stat, err := self.output.Stat()
-	if err != nil {
-		return -1
-	}
-	offset := stat.Size()
-
-	length := int64(len(data))
-
-	self.output.Seek(0, 1) // End of file
-	self.output.Write(data)
-	self.output.Sync()
-
-	self.AddIndex(index, offset, length)
-
-	self.last++
-
-	return self.last
-}
-
-func (self *Store) AddIndex(index int64, offset int64, length int64) {
-	fmt.Println("Adding to store index", index, offset, length)
-	fmt.Println(self.last)
-	stat, err := self.outindex.Stat()
-	if err != nil {
-		return
-	}
-	ioffset := stat.Size()
-	if ioffset%(8*3) != 0 {
-		roundedSize := (ioffset / (8 * 3)) * (8 * 3)
-		fmt.Println("Truncating index", ioffset, roundedSize)
-		self.outindex.Truncate(roundedSize)
-	}
-
-	elems := []int64{index, offset, length}
-	bss := make([][]byte, 3)
-	for i := 0; i < len(elems); i++ {
-		bss[i] = make([]byte, 8)
-		binary.PutVarint(bss[i], elems[i])
-	}
-
-	sep := make([]byte, 0)
-	data := bytes.Join(bss, sep)
-
-	self.outindex.Seek(0, 1) // End of file
-	self.outindex.Write(data)
-	self.outindex.Sync()
-}
-
-func (self *Store) FromIndexDo(index int64, handle func(*Record)) {
-	for current := index + 1; current <= self.LastIndex(); current++ {
-		record, err := self.GetRecord(current)
-		if err != nil {
-			fmt.Println("Error processing records")
-			fmt.Println(err)
-		} else {
-			go handle(record)
-		}
-	}
-}
-
-func (self *Store) Close() {
-	self.content.Close()
-	self.outindex.Close()
-	self.output.Close()
-}
@@ -3,41 +3,72 @@ package storage
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"sort"
 )
 
+// Counts of which byte follows which at each position of the training payloads, used to
+// extract a likely prefix.  Most (position, previous, current) combinations are never seen,
+// so only the ones that have been are kept.
 type Bytemap struct {
-	bytemap *os.File
+	path     string                // Path of the bytemap file
+	readonly bool                  // true if the bytemap can't be saved
+	rows     map[int32]*bytemapRow // key is position<<8 | previous byte
+	index    int64                 // index of the last record processed
+	saved    int64                 // index that was last written to the file
 }
 
-func NewReadonlyBytemap(name string) (*Bytemap, error) {
-	bytemap, err := os.OpenFile("store/"+name+"/bytemap", os.O_RDONLY, 0666)
+// The counts for the bytes that follow one byte at one position.
+type bytemapRow struct {
+	counts map[byte]int64
+	total  int64
+}
+
+// description of bytemap file:
+// header is composed of: 4 bytes of magic ("ALBM"), 4 bytes for the format version, 8 bytes for
+// the index of the last record processed.
+// Then one 16 byte entry for each count that isn't zero: 4 bytes for the position, 1 byte for the
+// previous byte, 1 byte for the current byte, 2 unused bytes, 8 bytes for the count.
+// All values are little endian.  The whole file is rewritten when the bytemap is saved.
+// Older bytemaps were a dense file of varints with a cell for every possible combination.  They
+// are converted when they are opened.
+
+func NewReadonlyBytemap(root *Root, name string) (*Bytemap, error) {
+	bytemap := &Bytemap{path: root.File(name, "bytemap"), readonly: true, rows: make(map[int32]*bytemapRow), index: 0}
+	err := bytemap.load()
 	if err != nil {
 		fmt.Println("Error opening bytemap file", err)
 		return nil, err
 	}
 
-	return &Bytemap{bytemap: bytemap}, nil
+	bytemap.saved = bytemap.index
+	return bytemap, nil
+}
+
+func NewBytemap(root *Root, name string) (*Bytemap, error) {
+	return NewBytemapFile(root, name, "bytemap")
 }
 
-func NewBytemap(name string) (*Bytemap, error) {
-	bytemap, err := os.OpenFile("store/"+name+"/bytemap", os.O_RDWR|os.O_CREATE, 0666)
+// Open a bytemap that is kept in a file other than "bytemap" in the dataset's directory, such
+// as the "bytemap-allow" and "bytemap-block" files kept by the training service.
+func NewBytemapFile(root *Root, name string, file string) (*Bytemap, error) {
+	bytemap := &Bytemap{path: root.File(name, file), readonly: false, rows: make(map[int32]*bytemapRow), index: 0}
+	err := bytemap.load()
+	if os.IsNotExist(err) {
+		// Nothing has been processed yet, so the first record is record 0.
+		bytemap.index = -1
+		err = bytemap.write()
+	}
 	if err != nil {
 		fmt.Println("Error opening bytemap file", err)
 		return nil, err
 	}
-	stat, err2 := bytemap.Stat()
-	if err2 != nil {
-		fmt.Println("Error getting size of bytemap file", err2)
-		return nil, err2
-	}
-	if stat.Size() == 0 {
-		zeros := make([]byte, 8)
-		bytemap.WriteAt(zeros, (1500*256*256+1)*8)
-	}
 
-	return &Bytemap{bytemap: bytemap}, nil
+	bytemap.saved = bytemap.index
+	return bytemap, nil
 }
 
 func (self *Bytemap) IncrementCount(index int, prev byte, current byte) {
@@ -47,50 +78,40 @@ func (self *Bytemap) IncrementCount(index int, prev byte, current byte) {
 }
 
 func (self *Bytemap) GetCount(index int, prev byte, current byte) int64 {
-	buff := make([]byte, 8)
-	offset := self.getOffset(index, prev, current)
-	self.bytemap.Seek(offset, 0)
-	self.bytemap.Read(buff)
-	value, _ := binary.Varint(buff)
-	return value
+	row, ok := self.rows[self.getRowKey(index, prev)]
+	if !ok {
+		return 0
+	}
+
+	return row.counts[current]
 }
 
 func (self *Bytemap) PutCount(index int, prev byte, current byte, count int64) {
-	buff := make([]byte, 8)
-	offset := self.getOffset(index, prev, current)
-	binary.PutVarint(buff, count)
-	self.bytemap.Seek(offset, 0)
-	self.bytemap.Write(buff)
+	key := self.getRowKey(index, prev)
+	row, ok := self.rows[key]
+	if !ok {
+		row = &bytemapRow{counts: make(map[byte]int64)}
+		self.rows[key] = row
+	}
+
+	row.total = row.total - row.counts[current] + count
+	if count == 0 {
+		delete(row.counts, current)
+	} else {
+		row.counts[current] = count
+	}
 }
 
 func (self *Bytemap) GetIndex() int64 {
-	self.bytemap.Sync()
-	buff := make([]byte, 8)
-	self.bytemap.Seek(0, 0)
-	_, err := self.bytemap.ReadAt(buff, 0)
-	if err != nil {
-		fmt.Println("Error reading", err, self.bytemap)
-	}
-	value, _ := binary.Varint(buff)
-	return value
+	return self.index
 }
 
 func (self *Bytemap) PutIndex(index int64) {
-	buff := make([]byte, 8)
-	binary.PutVarint(buff, index)
-	self.bytemap.Seek(0, 0)
-	_, err := self.bytemap.Write(buff)
-	if err != nil {
-		fmt.Println("Error writing", err)
-	}
-	self.bytemap.Sync()
+	self.index = index
 }
 
-func (self *Bytemap) getOffset(index int, prev byte, current byte) int64 {
-	cellsize := int64(8)
-	rowsize := int64(256 * 8)
-	blocksize := int64(256 * 256 * 8)
-	return (blocksize * int64(index)) + (rowsize * int64(prev)) + (cellsize * int64(current)) + 8
+func (self *Bytemap) getRowKey(index int, prev byte) int32 {
+	return int32(index)<<8 | int32(prev)
 }
 
 func (self *Bytemap) GetMax(index int, prev byte) (resultFound bool, resultIndex byte, count int64) {
@@ -102,11 +123,16 @@ func (self *Bytemap) GetMax(index int, prev byte) (resultFound bool, resultIndex
 	maxIndex = 0
 	maxCount = 0
 
-	for currentIndex := 0; currentIndex < 256; currentIndex++ {
-		currentCount := self.GetCount(index, prev, byte(currentIndex))
-		if (currentCount > 0) && (currentCount > maxCount) {
+	row, ok := self.rows[self.getRowKey(index, prev)]
+	if !ok {
+		return found, maxIndex, maxCount
+	}
+
+	// Ties go to the lowest byte, as they did when every cell was checked in order.
+	for currentIndex, currentCount := range row.counts {
+		if (currentCount > 0) && (currentCount > maxCount || (currentCount == maxCount && currentIndex < maxIndex)) {
 			found = true
-			maxIndex = byte(currentIndex)
+			maxIndex = currentIndex
 			maxCount = currentCount
 		}
 	}
@@ -115,16 +141,12 @@ func (self *Bytemap) GetMax(index int, prev byte) (resultFound bool, resultIndex
 }
 
 func (self *Bytemap) GetTotal(index int, prev byte) int64 {
-	var total int64
-
-	total = 0
-
-	for currentIndex := 0; currentIndex < 256; currentIndex++ {
-		currentCount := self.GetCount(index, prev, byte(currentIndex))
-		total = total + currentCount
+	row, ok := self.rows[self.getRowKey(index, prev)]
+	if !ok {
+		return 0
 	}
 
-	return total
+	return row.total
 }
 
 func (self *Bytemap) Extract() []byte {
@@ -140,7 +162,9 @@ func (self *Bytemap) Extract() []byte {
 		if foundMax {
 			freq := (count * 100) / total
 			if freq > 50 {
-				fmt.Println("Extracting", index, prev, next, freq)
+				if Debug {
+					fmt.Println("Extracting", index, prev, next, freq)
+				}
 				wbuff[0] = next
 				buff.Write(wbuff)
 				prev = next
@@ -167,7 +191,6 @@ func (self *Bytemap) ProcessBytes(record *Record) {
 		prev = value
 	}
 	self.PutIndex(record.Index)
-	self.bytemap.Sync()
 }
 
 func (self *Bytemap) ForceProcessBytes(record *Record) {
@@ -178,9 +201,157 @@ func (self *Bytemap) ForceProcessBytes(record *Record) {
 		prev = value
 	}
 	self.PutIndex(record.Index)
-	self.bytemap.Sync()
 }
 
+// Returns true if records were processed since the bytemap was last saved.
+func (self *Bytemap) Pending() bool {
+	return self.index != self.saved
+}
+
+// Write the counts and index to disk.
 func (self *Bytemap) Save() {
-	self.bytemap.Sync()
+	err := self.write()
+	if err != nil {
+		fmt.Println("Error saving bytemap", err)
+	}
+}
+
+// Rewrite the bytemap file.  The new file is written next to the old one and then swapped in,
+// so the counts and index on disk always match.
+func (self *Bytemap) write() error {
+	if self.readonly {
+		return errors.New("Bytemap is read-only")
+	}
+
+	var entries []bytemapEntry
+	for key, row := range self.rows {
+		for current, count := range row.counts {
+			entries = append(entries, bytemapEntry{key: key, current: current, count: count})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].key != entries[j].key {
+			return entries[i].key < entries[j].key
+		}
+		return entries[i].current < entries[j].current
+	})
+
+	data := make([]byte, bytemapHeaderSize+(int64(len(entries))*bytemapEntrySize))
+	copy(data[0:4], bytemapMagic)
+	binary.LittleEndian.PutUint32(data[4:8], bytemapVersion)
+	binary.LittleEndian.PutUint64(data[8:16], uint64(self.index))
+
+	for i, entry := range entries {
+		cell := data[bytemapHeaderSize+(int64(i)*bytemapEntrySize):]
+		binary.LittleEndian.PutUint32(cell[0:4], uint32(entry.key>>8))
+		cell[4] = byte(entry.key)
+		cell[5] = entry.current
+		binary.LittleEndian.PutUint64(cell[8:16], uint64(entry.count))
+	}
+
+	err := writeSynced(self.path+".new", data)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(self.path+".new", self.path)
+	if err != nil {
+		return err
+	}
+
+	self.saved = self.index
+	return nil
+}
+
+type bytemapEntry struct {
+	key     int32
+	current byte
+	count   int64
+}
+
+// Read the bytemap file into memory, converting it if it's an old dense bytemap.
+func (self *Bytemap) load() error {
+	file, err := os.Open(self.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, bytemapHeaderSize)
+	_, err = io.ReadFull(file, header)
+	if err == io.EOF || err == io.ErrUnexpectedEOF || string(header[0:4]) != bytemapMagic {
+		return self.loadDense(file, stat.Size())
+	} else if err != nil {
+		return err
+	}
+
+	version := binary.LittleEndian.Uint32(header[4:8])
+	if version != bytemapVersion {
+		return fmt.Errorf("Unsupported bytemap version %d in %s", version, self.path)
+	}
+	self.index = int64(binary.LittleEndian.Uint64(header[8:16]))
+
+	data := make([]byte, stat.Size()-bytemapHeaderSize)
+	_, err = io.ReadFull(file, data)
+	if err != nil {
+		return err
+	}
+
+	for position := int64(0); position+bytemapEntrySize <= int64(len(data)); position = position + bytemapEntrySize {
+		cell := data[position : position+bytemapEntrySize]
+		index := int(binary.LittleEndian.Uint32(cell[0:4]))
+		self.PutCount(index, cell[4], cell[5], int64(binary.LittleEndian.Uint64(cell[8:16])))
+	}
+
+	return nil
+}
+
+// Old bytemaps have an 8 byte varint for the index followed by an 8 byte varint cell for every
+// (position, previous, current) combination.  Read the cells that aren't zero a block at a time
+// and save the bytemap in the sparse format.
+func (self *Bytemap) loadDense(file *os.File, size int64) error {
+	if size == 0 {
+		return self.convert()
+	}
+
+	fmt.Println("Converting dense bytemap", self.path)
+
+	buff := make([]byte, int64Size)
+	_, err := file.ReadAt(buff, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	self.index, _ = binary.Varint(buff)
+
+	blocksize := int64(256 * 256 * int64Size)
+	block := make([]byte, blocksize)
+	for index := 0; int64(index)*blocksize+int64Size < size; index++ {
+		n, err := file.ReadAt(block, int64(index)*blocksize+int64Size)
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		for cell := 0; (cell+1)*int64Size <= n; cell++ {
+			value, _ := binary.Varint(block[cell*int64Size : (cell+1)*int64Size])
+			if value != 0 {
+				self.PutCount(index, byte(cell/256), byte(cell%256), value)
+			}
+		}
+	}
+
+	return self.convert()
+}
+
+// Save a converted bytemap in the sparse format, unless it's read-only.
+func (self *Bytemap) convert() error {
+	if self.readonly {
+		return nil
+	}
+
+	return self.write()
 }
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+)
+
+// DatasetConfig controls which offset/subsequence combinations are counted for a dataset.  It is
+// read from config.json in the dataset's directory (i.e. store/dataset1-incoming/config.json),
+// for example {"MinOffset": 0, "MaxOffset": 64, "MinLength": 2, "MaxLength": 16, "Scorer": "f1"}.
+// Changes only apply to packets that are processed after the server is restarted.
+type DatasetConfig struct {
+	MinOffset int // first offset that subsequences can start at
+	MaxOffset int // last offset that subsequences can start at
+	MinLength int // shortest subsequence that is counted
+	MaxLength int // longest subsequence that is counted, 0 for the rest of the payload
+
+	Scorer               string  // how rule candidates are compared, see NewScorer, "" for "difference"
+	MaxFalsePositiveRate float64 // for "precision", the most allowed traffic a rule can break
+	CollateralWeight     float64 // for "collateral", the cost of breaking allowed traffic relative to missing blocked traffic
+}
+
+// Without a config.json, only prefixes of the payload are counted.
+func DefaultDatasetConfig() *DatasetConfig {
+	return &DatasetConfig{MinOffset: 0, MaxOffset: 0, MinLength: 1, MaxLength: 0, Scorer: DifferenceScorerName, MaxFalsePositiveRate: 0.01, CollateralWeight: 1}
+}
+
+// Reads the config for a dataset, i.e. "dataset1-incoming".  Fields that are missing from the
+// file keep their default values.
+func LoadDatasetConfig(root *Root, name string) (*DatasetConfig, error) {
+	config := DefaultDatasetConfig()
+
+	data, err := ioutil.ReadFile(root.File(name, "config.json"))
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, config)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing config for %s: %s", name, err)
+	}
+
+	err = config.Check()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid config for %s: %s", name, err)
+	}
+
+	return config, nil
+}
+
+// Returns an error if the windows or the scorer don't make sense.  Offsets are encoded in two
+// bytes at the start of each sequence, so they have to fit in an int16.
+func (self *DatasetConfig) Check() error {
+	if self.MinOffset < 0 || self.MaxOffset < self.MinOffset || self.MaxOffset > math.MaxInt16 {
+		return fmt.Errorf("offsets must be between 0 and %d with MinOffset <= MaxOffset, got %d-%d", math.MaxInt16, self.MinOffset, self.MaxOffset)
+	}
+
+	if self.MinLength < 1 || (self.MaxLength != 0 && self.MaxLength < self.MinLength) {
+		return fmt.Errorf("lengths must be at least 1 with MinLength <= MaxLength, got %d-%d", self.MinLength, self.MaxLength)
+	}
+
+	if self.MaxFalsePositiveRate < 0 || self.MaxFalsePositiveRate > 1 || self.CollateralWeight < 0 {
+		return fmt.Errorf("MaxFalsePositiveRate must be between 0 and 1 and CollateralWeight can't be negative")
+	}
+
+	_, err := NewScorer(self)
+	return err
+}
@@ -0,0 +1,69 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestLoadDatasetConfig(t *testing.T) {
+	root := testRoot(t)
+	defer os.RemoveAll(root.Path)
+	os.Mkdir(root.Dir("testing"), 0777)
+
+	config, err := LoadDatasetConfig(root, "testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *config != *DefaultDatasetConfig() {
+		t.Error("Expected the default config", config)
+	}
+
+	ioutil.WriteFile(root.File("testing", "config.json"), []byte(`{"MaxOffset": 64, "MinLength": 2, "MaxLength": 16}`), 0666)
+	config, err = LoadDatasetConfig(root, "testing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MinOffset != 0 || config.MaxOffset != 64 || config.MinLength != 2 || config.MaxLength != 16 {
+		t.Error("Wrong config", config)
+	}
+
+	ioutil.WriteFile(root.File("testing", "config.json"), []byte(`{"MaxOffset": 40000}`), 0666)
+	_, err = LoadDatasetConfig(root, "testing")
+	if err == nil {
+		t.Error("Expected an offset that doesn't fit in an int16 to be rejected")
+	}
+}
+
+func TestOffsetSequenceMapWindow(t *testing.T) {
+	root := testRoot(t)
+	defer os.RemoveAll(root.Path)
+
+	config := &DatasetConfig{MinOffset: 1, MaxOffset: 2, MinLength: 2, MaxLength: 3}
+	osm, err := NewOffsetSequenceMap(NewStoreCache(root), "testing", make(chan *RuleCandidate, 1000), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	osm.ProcessBytes(true, []byte("ABCDEF"))
+	osm.ProcessBytes(false, []byte("ABC"))
+
+	// BC, BCD, CD and CDE from the first payload, BC from the second.
+	expected := []string{"\x01\x00BC", "\x01\x00BCD", "\x02\x00CD", "\x02\x00CDE"}
+	if osm.store.LastIndex() != int64(len(expected)-1) {
+		t.Fatal("Wrong number of sequences", osm.store.LastIndex()+1)
+	}
+	for index, sequence := range expected {
+		record, err := osm.store.GetRecord(int64(index))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(record.Data) != sequence {
+			t.Error("Wrong sequence", index, record.Data)
+		}
+	}
+
+	if osm.bytemap.GetCount(0, true) != 1 || osm.bytemap.GetCount(0, false) != 1 {
+		t.Error("Wrong counts for BC", osm.bytemap.GetCount(0, true), osm.bytemap.GetCount(0, false))
+	}
+}
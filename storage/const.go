@@ -1,5 +1,7 @@
 package storage
 
+import "time"
+
 const int64Size = 8
 const cellsize = int64(int64Size * 2)	//16
 const headerSize = cellsize * 2		//32
@@ -12,3 +14,40 @@ const storeCellByteSize = int64(int64Size * storeCellSize)
 const indexStoreCellOffset = 0 * int64Size
 const offsetStoreCellOffset = 1 * int64Size
 const lengthStoreCellOffset = 2 * int64Size
+const checksumStoreCellOffset = 3 * int64Size
+
+const indexMagic = "ALIX"
+const indexHeaderSize = int64(int64Size * 2)	//16
+const storeCellByteSizeV2 = int64(int64Size * 4)	//32
+
+const metaMagic = "ALMD"
+const metaVersion = uint32(1)
+const metaHeaderSize = int64(8)
+const metaCellSize = int64(int64Size * 3)	//24
+
+const (
+	metaFlagPresent  = 1 << iota // the record was added with metadata
+	metaFlagAllow                // the record was captured as allowed traffic
+	metaFlagIncoming             // the record was captured on incoming traffic
+)
+
+const countmapMagic = "ALCM"
+const countmapJournalMagic = "ALCJ"
+const countmapVersion = uint32(3)
+const countmapFlushRecords = 100		// training records between countmap flushes
+const countmapFlushInterval = 5 * time.Second	// longest time between countmap flushes
+
+const minPackets = 3		// packets of each label that have to be seen before rules are scored
+const minSupport = 3		// packets that have to match a rule before it is scored
+const wilsonZ = 1.96		// z-score for the 95% confidence intervals of the match rates
+
+const topkMagic = "ALTK"
+const topkVersion = uint32(2)
+const topkHeaderSize = int64(int64Size * 2)	//16
+const topkEntrySize = int64(int64Size * 5)	//40
+const topkSize = 10			// rule candidates kept for each dataset
+
+const bytemapMagic = "ALBM"
+const bytemapVersion = uint32(2)
+const bytemapHeaderSize = int64(int64Size * 2)	//16
+const bytemapEntrySize = int64(int64Size * 2)	//16
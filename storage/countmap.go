@@ -2,120 +2,211 @@ package storage
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"io/ioutil"
 	"os"
+	"time"
 )
 
 type Countmap struct {
-	bytemap *os.File		// Pointer to the countmap file
-	Best    *RuleCandidate		// initially nil
-	Updates chan *RuleCandidate	// Channel for best rule candidate updates
+	path      string		// Path of the countmap file
+	file      *os.File		// Pointer to the countmap file
+	cells     []int64		// Block count followed by allow count for each index, in memory
+	totals    [2]int64		// Total # of block and allow packets seen
+	last      int64			// Index of the last training record included in the counts, -1 if none
+	dirty     map[int64]bool	// Cells changed since the last flush
+	records   int			// Training records checkpointed since the last flush
+	flushed   time.Time		// Time of the last flush
+	Best      *RuleCandidate	// initially nil
+	Top       *TopK			// best rule candidates, best first
+	Updates   chan *RuleCandidate	// Channel for best rule candidate updates
+	scorer    Scorer		// How candidates are compared, nil for the default
+	legacy    bool			// Loaded from before version 3, so the totals have to be rebuilt with RebuildTotals
 }
 
 // description of countmap file:
-// header is composed of: 16 unused bytes, 8 bytes for total # blocked sequences seen,
-// 8 bytes for total # of allowed sequences seen.
+// header is composed of: 4 bytes of magic ("ALCM"), 4 bytes for the format version, 8 bytes for the
+// index of the last training record included in the counts, 8 bytes for total # blocked packets
+// seen, 8 bytes for total # of allowed packets seen.
 // For each index, have block count followed by allow count.
+// All values are fixed width little endian int64s.
+// Counts are kept in memory and flushed in batches.  A flush first writes the changed cells, the
+// totals and the checkpoint to a journal file, then writes them to the countmap file and removes
+// the journal.  If a flush is interrupted, the journal is applied again the next time the countmap
+// is opened, so the counts on disk always match the checkpoint.
+// The totals count packets, not subsequences.  Countmaps from before version 3 counted subsequences
+// in the totals, but each cell was already a count of packets, so the cells are kept and the totals
+// are rebuilt from them with RebuildTotals.  Version 1 countmaps (no magic, varints in each cell,
+// no checkpoint) are converted as well.
 
-func NewCountmap(name string, updates chan *RuleCandidate) (*Countmap, error) {
+// scorer decides which candidates are best, nil to use the DifferenceScorer.
+func NewCountmap(root *Root, name string, updates chan *RuleCandidate, scorer Scorer) (*Countmap, error) {
 	// Creates a file like store/dataset1-incoming-offsets-sequence/countmap
-	bytemap, err := os.OpenFile("store/"+name+"/countmap", os.O_RDWR|os.O_CREATE, 0666)
+	path := root.File(name, "countmap")
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
 	if err != nil {
 		fmt.Println("Error opening countmap file", err)
 		return nil, err
 	}
-	// stat, err2 := bytemap.Stat()
-	// if err2 != nil {
-	// 	fmt.Println("Error getting size of countmap file", err2)
-	// 	return nil, err2
-	// }
-	// if stat.Size() == 0 {
-	// 	zeros := make([]byte, int64Size)
-	// 	bytemap.WriteAt(zeros, (1500*256*256+1)*int64Size)
-	// }
 
-	return &Countmap{bytemap: bytemap, Best: nil, Updates: updates}, nil
+	top := NewTopK(root.File(name, "topk"), topkSize)
+	countmap := &Countmap{path: path, file: file, last: -1, dirty: make(map[int64]bool), flushed: time.Now(), Best: nil, Top: top, Updates: updates, scorer: scorer}
+
+	err = countmap.load()
+	if err != nil {
+		fmt.Println("Error loading countmap file", err)
+		file.Close()
+		return nil, err
+	}
+
+	// Finish a flush that was interrupted.
+	err = countmap.replayJournal()
+	if err != nil {
+		fmt.Println("Error replaying countmap journal", err)
+		file.Close()
+		return nil, err
+	}
+
+	// The top candidates are only a cache of the counts, so they can be found again from new
+	// training packets if they can't be read.
+	err = top.Load(countmap.candidate)
+	if err != nil {
+		fmt.Println("Error loading top rule candidates", err)
+	}
+
+	// Carry on from the best candidate before the restart rather than waiting for a new one.
+	candidates := top.Candidates()
+	if len(candidates) > 0 {
+		countmap.Best = candidates[0]
+	}
+
+	return countmap, nil
 }
 
-// index refers to a particular sequence in the source file.  Update both the number
-// of times this sequence has been seen for allow/block and the total number of
-// allow/block sequences now observed.
+// index refers to a particular sequence in the source file.  Update the number of allow/block
+// packets this sequence has been seen in.  The packet itself is counted in the totals by
+// IncrementTotal, once per packet.
 func (self *Countmap) IncrementCount(index int64, allowBlock bool) {
 	value := self.GetCount(index, allowBlock)
 	value++
 	self.PutCount(index, allowBlock, value)
 
-	self.IncrementTotal(allowBlock)
-
 	self.keepBest(index)
 }
 
 // Get number of times this sequence (referred to by its index) has been seen for allow/block.
 func (self *Countmap) GetCount(index int64, allowBlock bool) int64 {
-	// FIXME - check file length
-	offset := self.getOffset(index, allowBlock)
-	return self.getInt64(offset)
+	cell := self.getCell(index, allowBlock)
+	if cell >= int64(len(self.cells)) {
+		return 0
+	}
+
+	return self.cells[cell]
 }
 
 // Set number of times this sequence (referred to by its index) has been seen for allow/block.
 func (self *Countmap) PutCount(index int64, allowBlock bool, count int64) {
-	offset := self.getOffset(index, allowBlock)
-	self.putInt64(offset, count)
+	cell := self.getCell(index, allowBlock)
+	for cell >= int64(len(self.cells)) {
+		self.cells = append(self.cells, 0)
+	}
+
+	self.cells[cell] = count
+	self.dirty[cell] = true
 }
 
-// Increment number of allow/block sequences seen.
+// Increment number of allow/block packets seen.
 func (self *Countmap) IncrementTotal(allowBlock bool) {
 	value := self.GetTotal(allowBlock)
 	value++
 	self.PutTotal(allowBlock, value)
 }
 
-// not used
-func (self *Countmap) GetIndex(allowBlock bool) int64 {
-	self.bytemap.Sync()
-	offset := self.getHeaderOffset(indexHeaderOffset, allowBlock)
-	return self.getInt64(offset)
+// Get total number of allow/block packets seen.
+func (self *Countmap) GetTotal(allowBlock bool) int64 {
+	return self.totals[self.getTotalIndex(allowBlock)]
 }
 
-// not used
-func (self *Countmap) PutIndex(index int64, allowBlock bool) {
-	offset := self.getHeaderOffset(indexHeaderOffset, allowBlock)
-	self.putInt64(offset, index)
-	self.bytemap.Sync()
+// Set total number of allow/block packets seen.
+func (self *Countmap) PutTotal(allowBlock bool, total int64) {
+	self.totals[self.getTotalIndex(allowBlock)] = total
 }
 
-// Get total number of allow/block subsequences seen.
-func (self *Countmap) GetTotal(allowBlock bool) int64 {
-	self.bytemap.Sync()
-	offset := self.getHeaderOffset(totalHeaderOffset, allowBlock)
-	return self.getInt64(offset)
+// Index of the last training record included in the counts, -1 if none have been.
+func (self *Countmap) Last() int64 {
+	return self.last
 }
 
-// Set total number of allow/block subsequences seen.
-func (self *Countmap) PutTotal(allowBlock bool, total int64) {
-	offset := self.getHeaderOffset(totalHeaderOffset, allowBlock)
-	self.putInt64(offset, total)
-	self.bytemap.Sync()
+// Record that the counts now include the training record at index.  The counts are flushed
+// to disk every countmapFlushRecords records or countmapFlushInterval, whichever comes first.
+func (self *Countmap) Checkpoint(index int64) error {
+	self.last = index
+	self.records++
+
+	if self.records >= countmapFlushRecords || time.Since(self.flushed) >= countmapFlushInterval {
+		return self.Flush()
+	}
+
+	return nil
+}
+
+// Returns true if there are checkpointed records that haven't been flushed yet.
+func (self *Countmap) Pending() bool {
+	return self.records > 0
+}
+
+// Write the counts, totals and checkpoint to disk.
+func (self *Countmap) Flush() error {
+	journal := self.encodeJournal()
+
+	err := writeSynced(self.path+".journal", journal)
+	if err != nil {
+		return err
+	}
+
+	err = self.applyJournal(journal)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(self.path + ".journal")
+	if err != nil {
+		return err
+	}
+
+	self.dirty = make(map[int64]bool)
+	self.records = 0
+	self.flushed = time.Now()
+
+	// The totals have changed since the kept candidates were last scored.
+	self.Top.Rescore(self.candidate)
+	return self.Top.Save()
 }
 
 func (self *Countmap) Save() {
-	self.bytemap.Sync()
+	err := self.Flush()
+	if err != nil {
+		fmt.Println("Error saving countmap", err)
+	}
 }
 
 // index refers to a specific offset/subsequence combo, refers to where it is recorded in the store file.
 func (self *Countmap) candidate(index int64) *RuleCandidate {
-	ac := self.GetCount(index, true)	// # of times this offset/subsequence combo has been seen for accept packets
-	at := self.GetTotal(true)		// # of offset/subsequence combos (not necessarily distinct) seen for accept packets
-	bc := self.GetCount(index, false)	// # of times this offset/subsequence combo has been seen for block packets
-	bt := self.GetTotal(false)		// # of offset/subsequence combos (not necessarily distinct) seen for block packets
+	ac := self.GetCount(index, true)	// # of accept packets this offset/subsequence combo has been seen in
+	at := self.GetTotal(true)		// # of accept packets seen
+	bc := self.GetCount(index, false)	// # of block packets this offset/subsequence combo has been seen in
+	bt := self.GetTotal(false)		// # of block packets seen
 
-	return &RuleCandidate{Index: index, AllowCount: ac, AllowTotal: at, BlockCount: bc, BlockTotal: bt}
+	return &RuleCandidate{Index: index, AllowCount: ac, AllowTotal: at, BlockCount: bc, BlockTotal: bt, scorer: self.scorer}
 }
 
 // index is the index of the last seen offset/subsequence pairing. If this is a better rule than the
 // current better rule, updates the best rule field and pushes the rule candidate to the updates channel.
 func (self *Countmap) keepBest(index int64) {
 	c := self.candidate(index)
+	self.Top.Offer(c)
 	if c.Score() == 0 {
 		return
 	}
@@ -123,7 +214,7 @@ func (self *Countmap) keepBest(index int64) {
 	if self.Best == nil {	// Originally, no best rule is available, so use the first generated rule.
 		self.Best = c
 		if Debug {
-			fmt.Println("First best rule.", self.Best, self.Best.rawScore())
+			fmt.Println("First best rule.", self.Best, self.Best.Score())
 		} else {
 			fmt.Print("@")
 		}
@@ -132,7 +223,7 @@ func (self *Countmap) keepBest(index int64) {
 		if c.BetterThan(self.Best) {
 			self.Best = c
 			if Debug {
-				fmt.Println("New best rule!", self.Best, self.Best.rawScore())
+				fmt.Println("New best rule!", self.Best, self.Best.Score())
 			} else {
 				fmt.Print("*")
 			}
@@ -141,8 +232,8 @@ func (self *Countmap) keepBest(index int64) {
 	}
 }
 
-// header is composed of: 16 unused bytes, 8 bytes for total # blocked sequences seen,
-// 8 bytes for total # of allowed sequences seen.
+// header is composed of: 8 bytes of magic and version, 8 bytes for the checkpoint,
+// 8 bytes for total # blocked packets seen, 8 bytes for total # of allowed packets seen.
 func (self *Countmap) getHeaderOffset(headerIndex int64, allowBlock bool) int64 {
 	offset := headerIndex * cellsize
 	if allowBlock {
@@ -162,20 +253,255 @@ func (self *Countmap) getOffset(index int64, allowBlock bool) int64 {
 	return offset
 }
 
-// Get the value (int64) at the given offset in the countmap file.
-func (self *Countmap) getInt64(offset int64) int64 {
-	// FIXME - check file length
-	buff := make([]byte, int64Size)
-	self.bytemap.Seek(offset, 0)
-	self.bytemap.Read(buff)
-	value, _ := binary.Varint(buff)
-	return value
+// Position of the count in the in-memory cells, which are laid out like the file.
+func (self *Countmap) getCell(index int64, allowBlock bool) int64 {
+	return (self.getOffset(index, allowBlock) - headerSize) / int64Size
+}
+
+func (self *Countmap) getTotalIndex(allowBlock bool) int {
+	if allowBlock {
+		return 1
+	}
+
+	return 0
+}
+
+// Read the countmap file into memory.  Countmaps from before version 3 are marked as legacy so
+// that their totals are rebuilt.
+func (self *Countmap) load() error {
+	data, err := ioutil.ReadAll(self.file)
+	if err != nil {
+		return err
+	}
+
+	if len(data) == 0 {
+		return nil
+	}
+
+	if len(data) < int(headerSize) || string(data[0:4]) != countmapMagic {
+		self.loadVersion1(data)
+		return nil
+	}
+
+	version := binary.LittleEndian.Uint32(data[4:8])
+	if version > countmapVersion || version < 2 {
+		return fmt.Errorf("Unsupported countmap version %d in %s", version, self.path)
+	}
+	self.legacy = version < countmapVersion
+
+	self.last = int64(binary.LittleEndian.Uint64(data[int64Size:]))
+	self.totals[0] = int64(binary.LittleEndian.Uint64(data[self.getHeaderOffset(totalHeaderOffset, false):]))
+	self.totals[1] = int64(binary.LittleEndian.Uint64(data[self.getHeaderOffset(totalHeaderOffset, true):]))
+
+	count := (int64(len(data)) - headerSize) / int64Size
+	self.cells = make([]int64, count)
+	for cell := int64(0); cell < count; cell++ {
+		self.cells[cell] = int64(binary.LittleEndian.Uint64(data[headerSize+(cell*int64Size):]))
+	}
+
+	return nil
 }
 
-// Write the provided value and the provided offset to the countmap file.
-func (self *Countmap) putInt64(offset int64, value int64) {
-	buff := make([]byte, int64Size)
-	binary.PutVarint(buff, value)
-	self.bytemap.Seek(offset, 0)
-	self.bytemap.Write(buff)
+// Version 1 countmaps stored a varint in each 8 byte cell and had no checkpoint.  The file is
+// rewritten in the current format by RebuildTotals.
+func (self *Countmap) loadVersion1(data []byte) {
+	varint := func(offset int64) int64 {
+		if offset+int64Size > int64(len(data)) {
+			return 0
+		}
+		value, _ := binary.Varint(data[offset : offset+int64Size])
+		return value
+	}
+
+	count := (int64(len(data)) - headerSize) / int64Size
+	if count < 0 {
+		count = 0
+	}
+	self.cells = make([]int64, count)
+	for cell := int64(0); cell < count; cell++ {
+		self.cells[cell] = varint(headerSize + (cell * int64Size))
+	}
+
+	self.last = -1
+	self.legacy = true
+}
+
+// Returns true if the countmap is from before version 3 and its totals still count subsequences.
+func (self *Countmap) Legacy() bool {
+	return self.legacy
+}
+
+// Replace the totals of a legacy countmap with the number of allowed and blocked packets, rescore
+// the top candidates with them and write the countmap in the current format.
+func (self *Countmap) RebuildTotals(allowTotal int64, blockTotal int64) error {
+	fmt.Println("Converting countmap", self.path, "with", allowTotal, "allowed and", blockTotal, "blocked packets")
+
+	self.PutTotal(true, allowTotal)
+	self.PutTotal(false, blockTotal)
+
+	// Write the converted countmap next to the old one and then swap them.
+	converted := make([]byte, headerSize+(int64(len(self.cells))*int64Size))
+	self.encodeHeader(converted)
+	for cell, value := range self.cells {
+		binary.LittleEndian.PutUint64(converted[headerSize+(int64(cell)*int64Size):], uint64(value))
+	}
+
+	err := writeSynced(self.path+".converted", converted)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(self.path+".converted", self.path)
+	if err != nil {
+		return err
+	}
+
+	self.file.Close()
+	self.file, err = os.OpenFile(self.path, os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	self.legacy = false
+
+	// The saved candidates were scored with the old totals.
+	err = self.Top.Load(self.candidate)
+	if err != nil {
+		fmt.Println("Error loading top rule candidates", err)
+	}
+
+	self.Best = nil
+	candidates := self.Top.Candidates()
+	if len(candidates) > 0 {
+		self.Best = candidates[0]
+	}
+
+	return self.Top.Save()
+}
+
+func (self *Countmap) encodeHeader(data []byte) {
+	copy(data[0:4], countmapMagic)
+	binary.LittleEndian.PutUint32(data[4:8], countmapVersion)
+	binary.LittleEndian.PutUint64(data[int64Size:], uint64(self.last))
+	binary.LittleEndian.PutUint64(data[self.getHeaderOffset(totalHeaderOffset, false):], uint64(self.totals[0]))
+	binary.LittleEndian.PutUint64(data[self.getHeaderOffset(totalHeaderOffset, true):], uint64(self.totals[1]))
+}
+
+// description of journal file:
+// 4 bytes of magic ("ALCJ"), the 32 byte countmap header, 8 bytes for the number of changed
+// cells, then the cell number and value of each changed cell (8 bytes each), then the CRC-32C
+// of everything before it.
+func (self *Countmap) encodeJournal() []byte {
+	journal := make([]byte, 4+headerSize+int64Size+(int64(len(self.dirty))*cellsize)+4)
+	copy(journal[0:4], countmapJournalMagic)
+	self.encodeHeader(journal[4 : 4+headerSize])
+
+	position := 4 + headerSize
+	binary.LittleEndian.PutUint64(journal[position:], uint64(len(self.dirty)))
+	position = position + int64Size
+
+	for cell := range self.dirty {
+		binary.LittleEndian.PutUint64(journal[position:], uint64(cell))
+		binary.LittleEndian.PutUint64(journal[position+int64Size:], uint64(self.cells[cell]))
+		position = position + cellsize
+	}
+
+	binary.LittleEndian.PutUint32(journal[position:], crc32.Checksum(journal[:position], crcTable))
+
+	return journal
+}
+
+// Write the header and cells from a journal to the countmap file.
+func (self *Countmap) applyJournal(journal []byte) error {
+	_, err := self.file.WriteAt(journal[4:4+headerSize], 0)
+	if err != nil {
+		return err
+	}
+
+	position := 4 + headerSize
+	count := int64(binary.LittleEndian.Uint64(journal[position:]))
+	position = position + int64Size
+
+	value := make([]byte, int64Size)
+	for i := int64(0); i < count; i++ {
+		cell := int64(binary.LittleEndian.Uint64(journal[position:]))
+		copy(value, journal[position+int64Size:position+cellsize])
+		_, err = self.file.WriteAt(value, headerSize+(cell*int64Size))
+		if err != nil {
+			return err
+		}
+		position = position + cellsize
+	}
+
+	return self.file.Sync()
+}
+
+// Apply the journal left by an interrupted flush.  A journal that is incomplete was never
+// applied, so the countmap file still matches its checkpoint and the journal is thrown away.
+func (self *Countmap) replayJournal() error {
+	journal, err := ioutil.ReadFile(self.path + ".journal")
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if self.validJournal(journal) {
+		fmt.Println("Applying countmap journal", self.path)
+		err = self.applyJournal(journal)
+		if err != nil {
+			return err
+		}
+
+		_, err = self.file.Seek(0, 0)
+		if err != nil {
+			return err
+		}
+		err = self.load()
+		if err != nil {
+			return err
+		}
+	} else {
+		fmt.Println("Discarding incomplete countmap journal", self.path)
+	}
+
+	return os.Remove(self.path + ".journal")
+}
+
+func (self *Countmap) validJournal(journal []byte) bool {
+	minimum := 4 + headerSize + int64Size + 4
+	if int64(len(journal)) < minimum || string(journal[0:4]) != countmapJournalMagic {
+		return false
+	}
+
+	count := int64(binary.LittleEndian.Uint64(journal[4+headerSize:]))
+	if count < 0 || int64(len(journal)) != minimum+(count*cellsize) {
+		return false
+	}
+
+	position := int64(len(journal)) - 4
+	return crc32.Checksum(journal[:position], crcTable) == binary.LittleEndian.Uint32(journal[position:])
+}
+
+// Write data to a new file and sync it.
+func writeSynced(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		return errors.New("Error writing " + path + ": " + err.Error())
+	}
+
+	return nil
 }
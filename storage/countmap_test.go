@@ -0,0 +1,238 @@
+package storage
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestCountmapFlush(t *testing.T) {
+	root := testRoot(t)
+	defer os.RemoveAll(root.Path)
+	os.Mkdir(root.Dir("testing"), 0777)
+
+	countmap, err := NewCountmap(root, "testing", make(chan *RuleCandidate, 1000), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each sequence is in one packet with each label and one more allowed packet.
+	for i := int64(0); i < 10; i++ {
+		countmap.IncrementTotal(i%2 == 0)
+		countmap.IncrementCount(i, i%2 == 0)
+		countmap.IncrementTotal(true)
+		countmap.IncrementCount(i, true)
+	}
+	// Counts that don't fit in a varint in 8 bytes
+	countmap.PutCount(3, false, 1<<60)
+	countmap.Checkpoint(41)
+	countmap.Flush()
+	countmap.file.Close()
+
+	countmap, err = NewCountmap(root, "testing", make(chan *RuleCandidate, 1000), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if countmap.Last() != 41 {
+		t.Error("Wrong checkpoint", countmap.Last())
+	}
+	if countmap.GetTotal(true) != 15 || countmap.GetTotal(false) != 5 {
+		t.Error("Wrong totals", countmap.GetTotal(true), countmap.GetTotal(false))
+	}
+	if countmap.GetCount(4, true) != 2 || countmap.GetCount(5, true) != 1 || countmap.GetCount(5, false) != 1 {
+		t.Error("Wrong counts")
+	}
+	if countmap.GetCount(3, false) != 1<<60 {
+		t.Error("Large count was truncated", countmap.GetCount(3, false))
+	}
+	if countmap.GetCount(100, true) != 0 {
+		t.Error("Expected no count past the end")
+	}
+}
+
+func TestCountmapJournal(t *testing.T) {
+	root := testRoot(t)
+	defer os.RemoveAll(root.Path)
+	os.Mkdir(root.Dir("testing"), 0777)
+
+	countmap, err := NewCountmap(root, "testing", make(chan *RuleCandidate, 1000), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	countmap.IncrementCount(0, true)
+	countmap.Checkpoint(0)
+	countmap.Flush()
+
+	// Simulate a crash right after the journal was written.
+	countmap.IncrementCount(0, true)
+	countmap.IncrementCount(7, false)
+	countmap.Checkpoint(1)
+	writeSynced(countmap.path+".journal", countmap.encodeJournal())
+	countmap.file.Close()
+
+	countmap, err = NewCountmap(root, "testing", make(chan *RuleCandidate, 1000), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if countmap.Last() != 1 || countmap.GetCount(0, true) != 2 || countmap.GetCount(7, false) != 1 {
+		t.Error("Journal was not applied", countmap.Last(), countmap.GetCount(0, true), countmap.GetCount(7, false))
+	}
+
+	// Simulate a crash while the journal was being written.
+	countmap.IncrementCount(0, true)
+	countmap.Checkpoint(2)
+	journal := countmap.encodeJournal()
+	writeSynced(countmap.path+".journal", journal[:len(journal)-3])
+	countmap.file.Close()
+
+	countmap, err = NewCountmap(root, "testing", make(chan *RuleCandidate, 1000), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if countmap.Last() != 1 || countmap.GetCount(0, true) != 2 {
+		t.Error("Incomplete journal was applied", countmap.Last(), countmap.GetCount(0, true))
+	}
+
+	_, err = os.Stat(countmap.path + ".journal")
+	if !os.IsNotExist(err) {
+		t.Error("Journal was not removed")
+	}
+}
+
+func TestCountmapUpgrade(t *testing.T) {
+	root := testRoot(t)
+	defer os.RemoveAll(root.Path)
+
+	// Sequences at offset 0: "G" is in 2 blocked and 3 allowed packets, "GE" in 2 blocked and 1
+	// allowed and "P" in 1 of each, so there were 3 blocked and 4 allowed packets.
+	cache := NewStoreCache(root)
+	store, err := cache.Open("testing-offsets-sequence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Add([]byte{0, 0, 'G'})
+	store.Add([]byte{0, 0, 'G', 'E'})
+	store.Add([]byte{0, 0, 'P'})
+	counts := [][2]int64{{2, 3}, {2, 1}, {1, 1}}
+
+	// Version 1: varints, with totals that counted subsequences.
+	version1 := make([]byte, headerSize+(3*cellsize))
+	binary.PutVarint(version1[16:], 5)
+	binary.PutVarint(version1[24:], 5)
+	for i, count := range counts {
+		binary.PutVarint(version1[headerSize+(int64(i)*cellsize):], count[0])
+		binary.PutVarint(version1[headerSize+(int64(i)*cellsize)+int64Size:], count[1])
+	}
+
+	// Version 2: same layout as version 3, but the totals count subsequences.
+	version2 := make([]byte, headerSize+(3*cellsize))
+	copy(version2[0:4], countmapMagic)
+	binary.LittleEndian.PutUint32(version2[4:8], 2)
+	binary.LittleEndian.PutUint64(version2[8:16], 41)
+	binary.LittleEndian.PutUint64(version2[16:24], 5)
+	binary.LittleEndian.PutUint64(version2[24:32], 5)
+	for i, count := range counts {
+		binary.LittleEndian.PutUint64(version2[headerSize+(int64(i)*cellsize):], uint64(count[0]))
+		binary.LittleEndian.PutUint64(version2[headerSize+(int64(i)*cellsize)+int64Size:], uint64(count[1]))
+	}
+
+	for version, data := range map[int64][]byte{-1: version1, 41: version2} {
+		ioutil.WriteFile(root.File("testing-offsets-sequence", "countmap"), data, 0666)
+
+		sequences, err := NewSequenceMap(cache, "testing-offsets", make(chan *RuleCandidate, 1000), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		countmap := sequences.bytemap
+
+		if countmap.Last() != version || countmap.GetTotal(false) != 3 || countmap.GetTotal(true) != 4 {
+			t.Error("Wrong header", countmap.Last(), countmap.GetTotal(false), countmap.GetTotal(true))
+		}
+		for i, count := range counts {
+			if countmap.GetCount(int64(i), false) != count[0] || countmap.GetCount(int64(i), true) != count[1] {
+				t.Error("Counts were not kept", i)
+			}
+		}
+		countmap.file.Close()
+
+		upgraded, err := ioutil.ReadFile(root.File("testing-offsets-sequence", "countmap"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(upgraded[0:4]) != countmapMagic || binary.LittleEndian.Uint32(upgraded[4:8]) != countmapVersion {
+			t.Error("Countmap was not upgraded")
+		}
+
+		// Once it has been converted, it opens as it is.
+		countmap, err = NewCountmap(root, "testing-offsets-sequence", make(chan *RuleCandidate, 1000), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if countmap.Legacy() || countmap.GetTotal(true) != 4 || countmap.GetCount(1, false) != 2 {
+			t.Error("Wrong converted countmap", countmap.GetTotal(true), countmap.GetCount(1, false))
+		}
+		countmap.file.Close()
+	}
+}
+
+func TestCountmapTop(t *testing.T) {
+	root := testRoot(t)
+	defer os.RemoveAll(root.Path)
+	os.Mkdir(root.Dir("testing"), 0777)
+
+	countmap, err := NewCountmap(root, "testing", make(chan *RuleCandidate, 1000), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Sequence 0 is in every allowed packet and 1 in a quarter of them, 2 is in all but one
+	// blocked packet and 3 is in every packet.
+	for i := 0; i < 20; i++ {
+		countmap.IncrementTotal(true)
+		countmap.IncrementCount(0, true)
+		if i%4 == 0 {
+			countmap.IncrementCount(1, true)
+		}
+		countmap.IncrementCount(3, true)
+
+		countmap.IncrementTotal(false)
+		if i != 0 {
+			countmap.IncrementCount(2, false)
+		}
+		countmap.IncrementCount(3, false)
+	}
+	countmap.Checkpoint(39)
+	countmap.Flush()
+	countmap.file.Close()
+
+	countmap, err = NewCountmap(root, "testing", make(chan *RuleCandidate, 1000), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 1 and 3 don't separate the labels, so they aren't kept.
+	top := countmap.Top.Candidates()
+	if len(top) != 2 {
+		t.Fatal("Wrong number of candidates", len(top))
+	}
+	if top[0].Index != 0 || top[1].Index != 2 || top[1].BetterThan(top[0]) {
+		t.Error("Wrong candidates", top[0].Index, top[1].Index)
+	}
+	if top[1].BlockCount != 19 || top[1].BlockTotal != 20 {
+		t.Error("Candidate was not rescored from the counts", top[1])
+	}
+	if countmap.Best == nil || countmap.Best.Index != 0 {
+		t.Error("Best candidate was not restored", countmap.Best)
+	}
+
+	saved, err := LoadTopCandidates(root, "testing", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved) != 2 || saved[0].Index != 0 || saved[0].AllowCount != 20 || saved[1].BlockCount != 19 || saved[1].BlockTotal != 20 {
+		t.Error("Wrong saved candidates", saved)
+	}
+}
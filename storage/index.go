@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+)
+
+// description of index file:
+// Version 1 (stores created before checksums were added) has no header and a 24 byte cell
+// per record: 8 bytes each for the index, offset and length (varints).
+// Version 2 has a 16 byte header: 4 bytes of magic ("ALIX"), 4 bytes for the format version
+// (little endian) and 8 unused bytes.  Each record has a 32 byte cell: the index, offset and
+// length as in version 1, then the CRC-32C of the record's data and the CRC-32C of the first
+// 28 bytes of the cell (both little endian).
+// A record is committed once its whole cell is in the index file.  The cell is written with a
+// single write after the data has been synced to the source file and the metadata to the meta
+// file, so anything after the last complete, valid cell was never committed.
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type indexFormat struct {
+	version    uint32
+	headerSize int64 // bytes before the first cell
+	cellSize   int64 // bytes for each record
+}
+
+var indexFormatV1 = indexFormat{version: 1, headerSize: 0, cellSize: storeCellByteSize}
+var indexFormatV2 = indexFormat{version: 2, headerSize: indexHeaderSize, cellSize: storeCellByteSizeV2}
+
+// The information about one record that is kept in the index file.
+type indexCell struct {
+	Index    int64
+	Offset   int64  // where the record's data starts in the source file
+	Length   int64  // number of bytes of data
+	Checksum uint32 // CRC-32C of the data, version 2 only
+}
+
+// Work out the format of an index file from its first bytes.  Empty files get the current format.
+func detectIndexFormat(file io.ReaderAt, size int64) (indexFormat, error) {
+	if size == 0 {
+		return indexFormatV2, nil
+	}
+
+	magic := make([]byte, len(indexMagic))
+	if size < int64(len(magic)) {
+		magic = magic[:size]
+	}
+	_, err := file.ReadAt(magic, 0)
+	if err != nil {
+		return indexFormat{}, err
+	}
+
+	if size < int64(len(indexMagic)) {
+		// Either the header of a new store or the first cell of a version 1 store was torn.
+		if strings.HasPrefix(indexMagic, string(magic)) {
+			return indexFormatV2, nil
+		}
+		return indexFormatV1, nil
+	}
+
+	// Version 1 files start with the varint for index 0, which is a zero byte.
+	if string(magic) != indexMagic {
+		return indexFormatV1, nil
+	}
+
+	if size < indexHeaderSize {
+		// The header itself was torn, so there can't be any records yet.
+		return indexFormatV2, nil
+	}
+
+	header := make([]byte, indexHeaderSize)
+	_, err = file.ReadAt(header, 0)
+	if err != nil {
+		return indexFormat{}, err
+	}
+
+	version := binary.LittleEndian.Uint32(header[4:8])
+	if version != indexFormatV2.version {
+		return indexFormat{}, fmt.Errorf("Unsupported index file version %d", version)
+	}
+
+	return indexFormatV2, nil
+}
+
+// The bytes at the start of a new index file.
+func (self indexFormat) header() []byte {
+	header := make([]byte, self.headerSize)
+	if self.headerSize > 0 {
+		copy(header[0:4], indexMagic)
+		binary.LittleEndian.PutUint32(header[4:8], self.version)
+	}
+
+	return header
+}
+
+// Position of the cell for the record at index.
+func (self indexFormat) cellOffset(index int64) int64 {
+	return self.headerSize + (index * self.cellSize)
+}
+
+// Number of complete cells in an index file of the given size.
+func (self indexFormat) count(size int64) int64 {
+	if size <= self.headerSize {
+		return 0
+	}
+
+	return (size - self.headerSize) / self.cellSize
+}
+
+func (self indexFormat) checksum(data []byte) uint32 {
+	return crc32.Checksum(data, crcTable)
+}
+
+func (self indexFormat) encodeCell(cell indexCell) []byte {
+	data := make([]byte, self.cellSize)
+	binary.PutVarint(data[indexStoreCellOffset:], cell.Index)
+	binary.PutVarint(data[offsetStoreCellOffset:], cell.Offset)
+	binary.PutVarint(data[lengthStoreCellOffset:], cell.Length)
+
+	if self.version >= 2 {
+		binary.LittleEndian.PutUint32(data[checksumStoreCellOffset:], cell.Checksum)
+		binary.LittleEndian.PutUint32(data[checksumStoreCellOffset+4:], crc32.Checksum(data[:checksumStoreCellOffset+4], crcTable))
+	}
+
+	return data
+}
+
+// Read the cell for the record at index.  Returns an error if the cell is damaged.
+func (self indexFormat) readCell(file io.ReaderAt, index int64) (*indexCell, error) {
+	data := make([]byte, self.cellSize)
+	_, err := file.ReadAt(data, self.cellOffset(index))
+	if err != nil {
+		return nil, err
+	}
+
+	cell := &indexCell{}
+	cell.Index, _ = binary.Varint(data[indexStoreCellOffset:offsetStoreCellOffset])
+	cell.Offset, _ = binary.Varint(data[offsetStoreCellOffset:lengthStoreCellOffset])
+	cell.Length, _ = binary.Varint(data[lengthStoreCellOffset : lengthStoreCellOffset+int64Size])
+
+	if self.version >= 2 {
+		cell.Checksum = binary.LittleEndian.Uint32(data[checksumStoreCellOffset:])
+		expected := binary.LittleEndian.Uint32(data[checksumStoreCellOffset+4:])
+		if crc32.Checksum(data[:checksumStoreCellOffset+4], crcTable) != expected {
+			return nil, errors.New("Index cell checksum mismatch")
+		}
+	}
+
+	return cell, nil
+}
+
+// Check a record's data against the checksum in its cell.  Version 1 cells have no checksum.
+func (self indexFormat) checkData(cell *indexCell, data []byte) bool {
+	if self.version < 2 {
+		return true
+	}
+
+	return self.checksum(data) == cell.Checksum
+}
@@ -0,0 +1,181 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// RecordMeta describes how a stored training payload was captured.
+type RecordMeta struct {
+	AllowBlock bool   // true if the payload was captured as allowed traffic, false if blocked
+	Incoming   bool   // true if the payload was sent to the monitored port
+	Timestamp  int64  // capture time in Unix nanoseconds
+	Connection uint64 // id of the capture/connection the payload came from, 0 if unknown
+}
+
+// description of meta file:
+// header is composed of: 4 bytes of magic ("ALMD"), 4 bytes for the format version (little endian).
+// For each index in the store there is one 24 byte cell: 1 byte of flags, 7 unused bytes,
+// 8 bytes for the timestamp and 8 bytes for the connection id (both little endian).
+// Records added without metadata get a cell with the present flag cleared so that the
+// cells always line up with the index file.
+
+// Open the meta file for a store if there is one.  Stores that have never been given
+// metadata (such as the sequence stores) don't have a meta file and get nil.
+func openMeta(path string) (*os.File, error) {
+	meta, err := os.OpenFile(path, os.O_RDWR|os.O_SYNC, 0666)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	stat, err := meta.Stat()
+	if err != nil {
+		meta.Close()
+		return nil, err
+	}
+
+	// A torn header is rewritten when the store is recovered.
+	if stat.Size() < metaHeaderSize && tornMetaHeader(meta, stat.Size()) {
+		return meta, nil
+	}
+
+	err = checkMetaHeader(meta, path)
+	if err != nil {
+		meta.Close()
+		return nil, err
+	}
+
+	return meta, nil
+}
+
+// True if a meta file shorter than its header holds the start of a header, such as after a
+// crash while the meta file was being created.
+func tornMetaHeader(file io.ReaderAt, size int64) bool {
+	header := make([]byte, size)
+	_, err := file.ReadAt(header, 0)
+	if err != nil {
+		return false
+	}
+
+	expected := make([]byte, metaHeaderSize)
+	copy(expected[0:4], metaMagic)
+	binary.LittleEndian.PutUint32(expected[4:8], metaVersion)
+
+	return string(header) == string(expected[:size])
+}
+
+// Make a meta file long enough to have a cell for each of the count records in the store.
+// A torn header is rewritten and missing cells are filled with empty cells, so those records
+// read as unlabeled.  Returns the number of bytes that were written.
+func padMeta(file *os.File, size int64, count int64) (int64, error) {
+	metaLength := metaHeaderSize + (count * metaCellSize)
+	if size >= metaLength {
+		return 0, nil
+	}
+
+	// Start over from the header if it's torn, otherwise from the first incomplete cell.
+	start := int64(0)
+	if size >= metaHeaderSize {
+		start = metaHeaderSize + ((size-metaHeaderSize)/metaCellSize)*metaCellSize
+	}
+
+	padding := make([]byte, metaLength-start)
+	if start == 0 {
+		copy(padding[0:4], metaMagic)
+		binary.LittleEndian.PutUint32(padding[4:8], metaVersion)
+	}
+
+	_, err := file.WriteAt(padding, start)
+	if err != nil {
+		return 0, err
+	}
+
+	return metaLength - size, nil
+}
+
+// Make sure that a meta file has a header for a version that can be read.
+func checkMetaHeader(file io.ReaderAt, path string) error {
+	header := make([]byte, metaHeaderSize)
+	_, err := file.ReadAt(header, 0)
+	if err != nil {
+		return err
+	}
+
+	if string(header[0:4]) != metaMagic {
+		return errors.New("Invalid meta file " + path)
+	}
+
+	version := binary.LittleEndian.Uint32(header[4:8])
+	if version > metaVersion {
+		return fmt.Errorf("Unsupported meta file version %d in %s", version, path)
+	}
+
+	return nil
+}
+
+// Create a new meta file with a header and empty cells for the count records already in the store.
+func createMeta(path string, count int64) (*os.File, error) {
+	meta, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_SYNC, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, metaHeaderSize+(count*metaCellSize))
+	copy(header[0:4], metaMagic)
+	binary.LittleEndian.PutUint32(header[4:8], metaVersion)
+
+	_, err = meta.WriteAt(header, 0)
+	if err != nil {
+		meta.Close()
+		return nil, err
+	}
+
+	return meta, nil
+}
+
+// Write the metadata for the record at index.  A nil meta writes an empty cell.
+func putMeta(file *os.File, index int64, meta *RecordMeta) error {
+	cell := make([]byte, metaCellSize)
+	if meta != nil {
+		flags := byte(metaFlagPresent)
+		if meta.AllowBlock {
+			flags = flags | metaFlagAllow
+		}
+		if meta.Incoming {
+			flags = flags | metaFlagIncoming
+		}
+
+		cell[0] = flags
+		binary.LittleEndian.PutUint64(cell[8:16], uint64(meta.Timestamp))
+		binary.LittleEndian.PutUint64(cell[16:24], meta.Connection)
+	}
+
+	_, err := file.WriteAt(cell, metaHeaderSize+(index*metaCellSize))
+	return err
+}
+
+// Read the metadata for the record at index.  Returns nil if the record was added without any.
+func getMeta(file io.ReaderAt, index int64) (*RecordMeta, error) {
+	cell := make([]byte, metaCellSize)
+	_, err := file.ReadAt(cell, metaHeaderSize+(index*metaCellSize))
+	if err != nil {
+		return nil, err
+	}
+
+	flags := cell[0]
+	if flags&metaFlagPresent == 0 {
+		return nil, nil
+	}
+
+	return &RecordMeta{
+		AllowBlock: flags&metaFlagAllow != 0,
+		Incoming:   flags&metaFlagIncoming != 0,
+		Timestamp:  int64(binary.LittleEndian.Uint64(cell[8:16])),
+		Connection: binary.LittleEndian.Uint64(cell[16:24]),
+	}, nil
+}
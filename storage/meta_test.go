@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAddRecord(t *testing.T) {
+	root := testRoot(t)
+	defer os.RemoveAll(root.Path)
+
+	store, err := OpenStore(root, "testing-incoming")
+	if err != nil {
+		t.Fatal("Error opening store", err)
+	}
+
+	// A record without metadata followed by labeled ones
+	store.Add([]byte("unlabeled"))
+	store.AddRecord([]byte("allowed"), &RecordMeta{AllowBlock: true, Incoming: true, Timestamp: 1500000000000000000, Connection: 80})
+	store.AddRecord([]byte("blocked"), &RecordMeta{AllowBlock: false, Incoming: true, Timestamp: -1, Connection: 443})
+	store.Close()
+
+	store, err = OpenStore(root, "testing-incoming")
+	if err != nil {
+		t.Fatal("Error reopening store", err)
+	}
+	defer store.Close()
+
+	record, err := store.GetRecord(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Meta != nil {
+		t.Error("Expected no metadata", record.Meta)
+	}
+
+	record, err = store.GetRecord(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := RecordMeta{AllowBlock: true, Incoming: true, Timestamp: 1500000000000000000, Connection: 80}
+	if record.Meta == nil || *record.Meta != expected {
+		t.Error("Wrong metadata", record.Meta)
+	}
+
+	record, err = store.GetRecord(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = RecordMeta{AllowBlock: false, Incoming: true, Timestamp: -1, Connection: 443}
+	if record.Meta == nil || *record.Meta != expected {
+		t.Error("Wrong metadata", record.Meta)
+	}
+}
+
+func TestMetaFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "adversarylab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "testing-incoming.meta")
+
+	// Stores that have never had metadata don't have a meta file.
+	file, err := openMeta(path)
+	if file != nil || err != nil {
+		t.Fatal("Opened a missing meta file", err)
+	}
+
+	// Records added before the meta file was created get empty cells.
+	file, err = createMeta(path, 2)
+	if err != nil {
+		t.Fatal("Error creating meta file", err)
+	}
+	cells := []*RecordMeta{
+		nil,
+		nil,
+		{AllowBlock: true, Incoming: false, Timestamp: 1500000000000000000, Connection: 1},
+		nil,
+		{AllowBlock: false, Incoming: true, Timestamp: -1, Connection: 18446744073709551615},
+	}
+	for index := int64(2); index < int64(len(cells)); index++ {
+		err = putMeta(file, index, cells[index])
+		if err != nil {
+			t.Fatal("Error writing meta", err)
+		}
+	}
+	file.Close()
+
+	file, err = openMeta(path)
+	if err != nil || file == nil {
+		t.Fatal("Error reopening meta file", err)
+	}
+	defer file.Close()
+
+	for index, expected := range cells {
+		meta, err := getMeta(file, int64(index))
+		if err != nil {
+			t.Fatal("Error reading meta", index, err)
+		}
+		if (meta == nil) != (expected == nil) || (meta != nil && *meta != *expected) {
+			t.Error("Wrong metadata", index, meta)
+		}
+	}
+
+	// Meta files from a newer version can't be read.
+	file.WriteAt([]byte{byte(metaVersion + 1)}, 4)
+	err = checkMetaHeader(file, path)
+	if err == nil {
+		t.Error("Accepted a meta file from a newer version")
+	}
+	file.WriteAt([]byte("XXXX"), 0)
+	err = checkMetaHeader(file, path)
+	if err == nil {
+		t.Error("Accepted a meta file with the wrong magic")
+	}
+}
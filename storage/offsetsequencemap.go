@@ -7,18 +7,24 @@ import (
 
 type OffsetSequenceMap struct {
 	*SequenceMap
+	config *DatasetConfig	// offsets and lengths of the subsequences that are counted
 }
 
-func NewOffsetSequenceMap(name string, updates chan *RuleCandidate) (*OffsetSequenceMap, error) {
-	result, err := NewSequenceMap(name+"-offsets", updates)
+func NewOffsetSequenceMap(cache *StoreCache, name string, updates chan *RuleCandidate, config *DatasetConfig) (*OffsetSequenceMap, error) {
+	scorer, err := NewScorer(config)
 	if err != nil {
 		return nil, err
 	}
 
-	return &OffsetSequenceMap{SequenceMap: result}, nil
+	result, err := NewSequenceMap(cache, name+"-offsets", updates, scorer)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OffsetSequenceMap{SequenceMap: result, config: config}, nil
 }
 
-// offset currently always 0 0.  Increment the number of times this offset/subsequence combo has been
+// Increment the number of times this offset/subsequence combo has been
 // seen for allow/block as well as the total number of allow/block subsequences now seen.
 func (self *OffsetSequenceMap) Increment(allowBlock bool, offset int16, bs []byte) {
 	buff := new(bytes.Buffer)
@@ -34,18 +40,20 @@ func (self *OffsetSequenceMap) Increment(allowBlock bool, offset int16, bs []byt
 }
 
 // Process a new training packet. The input sequence is the full training packet payload.
+// Counts every subsequence that starts within the configured offsets and has one of the configured
+// lengths, so the work per packet is bounded by the size of the window rather than the payload.
 func (self *OffsetSequenceMap) ProcessBytes(allowBlock bool, sequence []byte) {
-	var length int16
-	var offset int16	// currently always 0
-	// Cycle through the byte sequences that always start at the beginning
-	for length = 1; length <= int16(len(sequence)); length++ {
-		// for offset = 0; offset+length <= int16(len(sequence)); offset++ {
-		// 	self.Increment(allowBlock, offset, sequence[int(offset):int(offset+length)])
-		// }
-
-		offset = 0
-		self.Increment(allowBlock, offset, sequence[int(offset):int(offset+length)])
+	self.CountPacket(allowBlock)
+	for offset := self.config.MinOffset; offset <= self.config.MaxOffset && offset < len(sequence); offset++ {
+		maxLength := len(sequence) - offset
+		if self.config.MaxLength != 0 && self.config.MaxLength < maxLength {
+			maxLength = self.config.MaxLength
+		}
+
+		for length := self.config.MinLength; length <= maxLength; length++ {
+			self.Increment(allowBlock, int16(offset), sequence[offset:offset+length])
+		}
 	}
 
-	self.bytemap.Save()	// commit the countmap file to disk
+	self.Sync()
 }
@@ -0,0 +1,119 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+
+	"golang.org/x/exp/mmap"
+)
+
+// A read-only view of a store, used by offline tools.  The files are memory mapped when the
+// store is opened, so it can be opened while the server is adding to the same store.  Only
+// the records that were committed when it was opened are visible.
+type ReadonlyStore struct {
+	Path     string         // something like "dataset1-incoming"
+	format   indexFormat    // layout of the index file
+	outindex *mmap.ReaderAt // index file that records index -> index/offset/length info
+	output   *mmap.ReaderAt // source file that records data concatenated together
+	meta     *mmap.ReaderAt // meta file that records index -> label/direction/timestamp/connection, nil if unused
+	last     int64          // the index of the last committed record
+}
+
+// Maps the index, source and meta files of an existing store.
+func OpenReadonlyStore(root *Root, path string) (*ReadonlyStore, error) {
+	// The index is mapped first.  Data and metadata are synced before the index cell that
+	// commits them is written, so every complete cell in the mapped index points to data
+	// that is in the source and meta files mapped after it.
+	outindex, err := mmap.Open(root.File(path, "index"))
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := mmap.Open(root.File(path, "source"))
+	if err != nil {
+		outindex.Close()
+		return nil, err
+	}
+
+	store := &ReadonlyStore{Path: path, outindex: outindex, output: output, last: -1}
+
+	meta, err := mmap.Open(root.File(path, "meta"))
+	if err == nil {
+		// A meta file that doesn't have its header yet is still being created for a record
+		// that isn't committed.
+		if int64(meta.Len()) >= metaHeaderSize {
+			err = checkMetaHeader(meta, root.File(path, "meta"))
+			if err != nil {
+				store.Close()
+				meta.Close()
+				return nil, err
+			}
+			store.meta = meta
+		} else {
+			meta.Close()
+		}
+	}
+
+	indexLength := int64(outindex.Len())
+	store.format, err = detectIndexFormat(outindex, indexLength)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	// Skip any cells at the end that are still being written.
+	count := store.format.count(indexLength)
+	for count > 0 && committedEnd(store.format, outindex, output, int64(output.Len()), count-1) < 0 {
+		count--
+	}
+	store.last = count - 1
+
+	return store, nil
+}
+
+// Get the Record at a given index (0-indexed).
+func (self *ReadonlyStore) GetRecord(index int64) (*Record, error) {
+	if index < 0 || index > self.last {
+		return nil, fmt.Errorf("Record %d is not in %s", index, self.Path)
+	}
+
+	var meta io.ReaderAt
+	if self.meta != nil {
+		meta = self.meta
+	}
+
+	return readRecord(self.format, self.outindex, self.output, meta, index)
+}
+
+// Returns the index of the last record that was committed when the store was opened.
+func (self *ReadonlyStore) LastIndex() int64 {
+	return self.last
+}
+
+// Calls handle with each record after index, in order.
+func (self *ReadonlyStore) BlockingFromIndexDo(index int64, handle func(*Record)) {
+	for current := index + 1; current <= self.LastIndex(); current++ {
+		record, err := self.GetRecord(current)
+		if err != nil {
+			fmt.Println("Error processing records")
+			fmt.Println(err)
+		} else {
+			handle(record)
+		}
+	}
+}
+
+// Sends each record after index to the channel, in order.
+func (self *ReadonlyStore) FromIndexDo(index int64, channel chan *Record) {
+	self.BlockingFromIndexDo(index, func(record *Record) {
+		channel <- record
+	})
+}
+
+func (self *ReadonlyStore) Close() {
+	self.outindex.Close()
+	self.output.Close()
+	if self.meta != nil {
+		self.meta.Close()
+	}
+}
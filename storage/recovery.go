@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+)
+
+// RecoveryReport describes what was dropped from the end of a store when it was opened.
+// Only records that were never fully committed, such as ones being added when the server
+// crashed, are dropped.
+type RecoveryReport struct {
+	DroppedRecords     int64 // complete index cells that were dropped because they were invalid
+	DroppedIndexBytes  int64
+	DroppedSourceBytes int64
+	DroppedMetaBytes   int64
+	PaddedMetaBytes    int64 // bytes added to a meta file that was torn or missing cells for committed records
+}
+
+func (self *RecoveryReport) String() string {
+	return fmt.Sprintf("dropped %d records (%d index bytes, %d source bytes, %d meta bytes), padded %d meta bytes", self.DroppedRecords, self.DroppedIndexBytes, self.DroppedSourceBytes, self.DroppedMetaBytes, self.PaddedMetaBytes)
+}
+
+// Find the last committed record and truncate the index, source and meta files right after it.
+// A meta file that is too short for the committed records is padded with empty cells.
+// A record is committed if its index cell is complete, undamaged, in sequence and points to
+// data that is all in the source file and matches its checksum.  Returns nil if nothing was dropped.
+func (self *Store) recover() (*RecoveryReport, error) {
+	report := &RecoveryReport{}
+
+	count := self.format.count(self.expectedOutindexLength)
+
+	// Walk back from the last cell until one checks out.  Cells before it were committed
+	// before it was, so they don't need to be checked here.
+	var sourceLength int64
+	for count > 0 {
+		sourceLength = committedEnd(self.format, self.outindex, self.output, self.expectedOutputLength, count-1)
+		if sourceLength >= 0 {
+			break
+		}
+
+		count--
+		report.DroppedRecords++
+	}
+	if count == 0 {
+		sourceLength = 0
+	}
+
+	indexLength := self.format.cellOffset(count)
+	if self.expectedOutindexLength > indexLength {
+		err := self.outindex.Truncate(indexLength)
+		if err != nil {
+			return nil, err
+		}
+		report.DroppedIndexBytes = self.expectedOutindexLength - indexLength
+		self.expectedOutindexLength = indexLength
+	}
+
+	if self.expectedOutputLength > sourceLength {
+		err := self.output.Truncate(sourceLength)
+		if err != nil {
+			return nil, err
+		}
+		report.DroppedSourceBytes = self.expectedOutputLength - sourceLength
+		self.expectedOutputLength = sourceLength
+	}
+
+	if self.meta != nil {
+		stat, err := self.meta.Stat()
+		if err != nil {
+			return nil, err
+		}
+
+		metaLength := metaHeaderSize + (count * metaCellSize)
+		if stat.Size() > metaLength {
+			err = self.meta.Truncate(metaLength)
+			if err != nil {
+				return nil, err
+			}
+			report.DroppedMetaBytes = stat.Size() - metaLength
+		}
+
+		report.PaddedMetaBytes, err = padMeta(self.meta, stat.Size(), count)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if report.DroppedIndexBytes == 0 && report.DroppedSourceBytes == 0 && report.DroppedMetaBytes == 0 && report.PaddedMetaBytes == 0 {
+		return nil, nil
+	}
+
+	return report, nil
+}
+
+// Check the record at index and return where its data ends in the source file, or -1 if
+// the record was not committed.
+func committedEnd(format indexFormat, outindex io.ReaderAt, output io.ReaderAt, outputLength int64, index int64) int64 {
+	cell, err := format.readCell(outindex, index)
+	if err != nil {
+		return -1
+	}
+
+	if cell.Index != index || cell.Length <= 0 || cell.Offset < 0 || cell.Offset+cell.Length > outputLength {
+		return -1
+	}
+
+	data := make([]byte, cell.Length)
+	_, err = output.ReadAt(data, cell.Offset)
+	if err != nil || !format.checkData(cell, data) {
+		return -1
+	}
+
+	return cell.Offset + cell.Length
+}
@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Root is the directory that holds all of the stores, bytemaps and countmaps for one lab.
+// A process can host several independent labs by opening a Root for each directory.
+type Root struct {
+	Path string // i.e. "store" or "/var/lib/adversarylab/experiment1"
+}
+
+// Opens the lab in the given directory, creating the directory if it doesn't already exist.
+func NewRoot(path string) (*Root, error) {
+	err := os.MkdirAll(path, 0777)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Root{Path: path}, nil
+}
+
+// Returns the directory for a store, i.e. store/dataset1-incoming
+func (self *Root) Dir(name string) string {
+	return filepath.Join(self.Path, name)
+}
+
+// Returns the path of a file in a store's directory, i.e. store/dataset1-incoming/index
+func (self *Root) File(name string, file string) string {
+	return filepath.Join(self.Path, name, file)
+}
+
+// Returns the names of the stores that hold training packets (i.e. "dataset1-incoming"),
+// skipping the sequence stores that are derived from them.
+func (self *Root) ListDatasets() ([]string, error) {
+	files, err := ioutil.ReadDir(self.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, file := range files {
+		if !file.IsDir() || strings.HasSuffix(file.Name(), "-sequence") {
+			continue
+		}
+
+		names = append(names, file.Name())
+	}
+
+	return names, nil
+}
@@ -3,10 +3,16 @@ package storage
 import "math"
 
 // A rule candidate is represented by an index, which represents an offset/subsequence combo.
+// The counts are numbers of packets: AllowCount of the AllowTotal allowed packets contained the
+// sequence, and BlockCount of the BlockTotal blocked packets did.
 // The ideal candidate has BlockCount close to BlockTotal and AllowCount far from AllowTotal if
 // this rule candidate is going to be used for blocking data.  Want high bc/bt - ac/at.
 // The ideal candidate has AllowCount close to AllowTotal and BlockCount far from BlockTotal if
 // this rule candidate is going to be used for allowing data.  Want high ac/at - bc/bt.
+// How a candidate is scored is up to its Scorer.  The default compares the pessimistic end of the
+// confidence interval of one rate with the optimistic end of the other, since the rates are only
+// estimates from the packets seen so far and a candidate seen in a handful of packets shouldn't
+// look perfect.
 
 type RuleCandidate struct {
 	Index      int64
@@ -14,30 +20,98 @@ type RuleCandidate struct {
 	AllowTotal int64
 	BlockCount int64
 	BlockTotal int64
+	scorer     Scorer // nil for the DifferenceScorer
 }
 
 func (self *RuleCandidate) BetterThan(other *RuleCandidate) bool {
 	return self.Score() > other.Score()
 }
 
+// How good the candidate is as a rule, 0 if it isn't supported by enough packets to be used.
 func (self *RuleCandidate) Score() float64 {
-	return math.Abs(self.rawScore())
+	if !self.Supported() {
+		return 0
+	}
+
+	if self.scorer == nil {
+		return DifferenceScorer{}.Score(self)
+	}
+
+	return self.scorer.Score(self)
 }
 
 // Return true if the rule should be used for allowing.  Return false if the rule
 // should be used for blocking.
 func (self *RuleCandidate) RequireForbid() bool {
-	return self.rawScore() > 0
+	return self.AllowRate() > self.BlockRate()
+}
+
+// Fraction of the allowed packets that contained the sequence.
+func (self *RuleCandidate) AllowRate() float64 {
+	return rate(self.AllowCount, self.AllowTotal)
 }
 
-func (self *RuleCandidate) rawScore() float64 {
-	// If haven't seen more than 3 subsequences yet, return 0.  (Thought this
-	// was supposed to be 3 overall packets, not subsequences?)
-	if self.AllowTotal < 3 || self.BlockTotal < 3 {
+// Fraction of the blocked packets that contained the sequence.
+func (self *RuleCandidate) BlockRate() float64 {
+	return rate(self.BlockCount, self.BlockTotal)
+}
+
+// Confidence interval for the fraction of all allowed traffic that contains the sequence.
+func (self *RuleCandidate) AllowInterval() (low float64, high float64) {
+	return wilson(self.AllowCount, self.AllowTotal)
+}
+
+// Confidence interval for the fraction of all blocked traffic that contains the sequence.
+func (self *RuleCandidate) BlockInterval() (low float64, high float64) {
+	return wilson(self.BlockCount, self.BlockTotal)
+}
+
+// Returns true if enough packets have been seen to score the candidate: at least minPackets
+// of each label, and at least minSupport packets matching the label the rule would pick out.
+func (self *RuleCandidate) Supported() bool {
+	if self.AllowTotal < minPackets || self.BlockTotal < minPackets {
+		return false
+	}
+
+	if self.RequireForbid() {
+		return self.AllowCount >= minSupport
+	}
+
+	return self.BlockCount >= minSupport
+}
+
+// What would happen to the packets seen so far if an adversary used the rule: blocked packets it
+// caught, allowed packets it broke, blocked packets it missed and allowed packets it passed.  A
+// block rule blocks the packets that match it and an allow rule blocks the ones that don't.
+func (self *RuleCandidate) Outcomes() (caught int64, broken int64, missed int64, passed int64) {
+	if self.RequireForbid() {
+		return self.BlockTotal - self.BlockCount, self.AllowTotal - self.AllowCount, self.BlockCount, self.AllowCount
+	}
+
+	return self.BlockCount, self.AllowCount, self.BlockTotal - self.BlockCount, self.AllowTotal - self.AllowCount
+}
+
+func rate(count int64, total int64) float64 {
+	if total == 0 {
 		return 0
 	}
 
-	allow := float64(self.AllowCount) / float64(self.AllowTotal)
-	block := float64(self.BlockCount) / float64(self.BlockTotal)
-	return allow - block
+	return float64(count) / float64(total)
+}
+
+// Wilson score interval for count successes in total trials.  Unlike count/total plus or minus
+// a margin, it stays between 0 and 1 and is wide when there are few trials.
+func wilson(count int64, total int64) (low float64, high float64) {
+	if total == 0 {
+		return 0, 1
+	}
+
+	n := float64(total)
+	p := float64(count) / n
+	z2 := wilsonZ * wilsonZ
+
+	center := (p + z2/(2*n)) / (1 + z2/n)
+	margin := (wilsonZ / (1 + z2/n)) * math.Sqrt((p*(1-p)/n)+(z2/(4*n*n)))
+
+	return math.Max(center-margin, 0), math.Min(center+margin, 1)
 }
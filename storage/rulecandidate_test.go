@@ -0,0 +1,42 @@
+package storage
+
+import "testing"
+
+func TestRuleCandidate(t *testing.T) {
+	small := &RuleCandidate{AllowCount: 3, AllowTotal: 3, BlockCount: 0, BlockTotal: 3}
+	large := &RuleCandidate{AllowCount: 300, AllowTotal: 300, BlockCount: 0, BlockTotal: 300}
+	if small.AllowRate() != 1 || small.BlockRate() != 0 {
+		t.Error("Wrong rates", small.AllowRate(), small.BlockRate())
+	}
+	if !large.BetterThan(small) {
+		t.Error("A perfect rule from a few packets should score lower than one from many", small.Score(), large.Score())
+	}
+	if !small.RequireForbid() || !large.RequireForbid() {
+		t.Error("Expected allow rules")
+	}
+
+	low, high := small.AllowInterval()
+	if low <= 0 || low >= 1 || high != 1 {
+		t.Error("Wrong interval", low, high)
+	}
+
+	block := &RuleCandidate{AllowCount: 1, AllowTotal: 100, BlockCount: 90, BlockTotal: 100}
+	if block.RequireForbid() || block.Score() <= 0 {
+		t.Error("Expected a block rule", block.Score())
+	}
+
+	unsupported := []*RuleCandidate{
+		{AllowCount: 2, AllowTotal: 2, BlockCount: 0, BlockTotal: 100},   // too few allowed packets
+		{AllowCount: 2, AllowTotal: 100, BlockCount: 0, BlockTotal: 100}, // too few matches
+	}
+	for _, candidate := range unsupported {
+		if candidate.Supported() || candidate.Score() != 0 {
+			t.Error("Expected no score", candidate)
+		}
+	}
+
+	overlapping := &RuleCandidate{AllowCount: 6, AllowTotal: 10, BlockCount: 4, BlockTotal: 10}
+	if overlapping.Score() != 0 {
+		t.Error("Expected no score when the intervals overlap", overlapping.Score())
+	}
+}
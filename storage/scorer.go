@@ -0,0 +1,124 @@
+package storage
+
+import (
+	"fmt"
+	"math"
+)
+
+// A Scorer decides how good a rule candidate is.  Higher scores are better, and candidates with
+// a score of 0 are never used.  Scorers are only given candidates that are Supported.
+// Which scorer a dataset uses is set by the Scorer field of its config.json.
+type Scorer interface {
+	Score(candidate *RuleCandidate) float64
+}
+
+// The names that can be used for the Scorer field of config.json.
+const (
+	DifferenceScorerName = "difference"  // the default
+	InformationGainName  = "information" // mutual information between the label and the rule
+	F1ScorerName         = "f1"          // F1 score for blocking the blocked traffic
+	PrecisionScorerName  = "precision"   // precision, as long as the false positive rate is low enough
+	CollateralScorerName = "collateral"  // blocked traffic caught, minus a penalty for allowed traffic broken
+)
+
+// Make the scorer configured for a dataset.
+func NewScorer(config *DatasetConfig) (Scorer, error) {
+	switch config.Scorer {
+	case "", DifferenceScorerName:
+		return DifferenceScorer{}, nil
+	case InformationGainName:
+		return InformationGainScorer{}, nil
+	case F1ScorerName:
+		return F1Scorer{}, nil
+	case PrecisionScorerName:
+		return PrecisionScorer{MaxFalsePositiveRate: config.MaxFalsePositiveRate}, nil
+	case CollateralScorerName:
+		return CollateralScorer{Weight: config.CollateralWeight}, nil
+	default:
+		return nil, fmt.Errorf("unknown scorer %q", config.Scorer)
+	}
+}
+
+// The difference between the pessimistic end of the confidence interval of the matching label's
+// rate and the optimistic end of the other label's rate.  Want high ac/at - bc/bt for allow rules
+// and high bc/bt - ac/at for block rules.
+type DifferenceScorer struct{}
+
+func (self DifferenceScorer) Score(candidate *RuleCandidate) float64 {
+	allowLow, allowHigh := candidate.AllowInterval()
+	blockLow, blockHigh := candidate.BlockInterval()
+
+	if candidate.RequireForbid() {
+		return math.Max(allowLow-blockHigh, 0)
+	}
+
+	return math.Max(blockLow-allowHigh, 0)
+}
+
+// How many bits of information about the label of a packet the rule gives.
+type InformationGainScorer struct{}
+
+func (self InformationGainScorer) Score(candidate *RuleCandidate) float64 {
+	caught, broken, missed, passed := candidate.Outcomes()
+	total := caught + broken + missed + passed
+
+	before := entropy(caught+missed, broken+passed)
+	after := (float64(caught+broken)/float64(total))*entropy(caught, broken) + (float64(missed+passed)/float64(total))*entropy(missed, passed)
+
+	return math.Max(before-after, 0)
+}
+
+// F1 score, the harmonic mean of precision and recall, treating blocked packets as the ones the
+// rule should catch.
+type F1Scorer struct{}
+
+func (self F1Scorer) Score(candidate *RuleCandidate) float64 {
+	caught, broken, missed, _ := candidate.Outcomes()
+	if caught == 0 {
+		return 0
+	}
+
+	return float64(2*caught) / float64((2*caught)+broken+missed)
+}
+
+// Fraction of the packets the rule blocks that should have been blocked, for rules that break no
+// more than MaxFalsePositiveRate of the allowed traffic.
+type PrecisionScorer struct {
+	MaxFalsePositiveRate float64
+}
+
+func (self PrecisionScorer) Score(candidate *RuleCandidate) float64 {
+	caught, broken, _, passed := candidate.Outcomes()
+	if caught == 0 || rate(broken, broken+passed) > self.MaxFalsePositiveRate {
+		return 0
+	}
+
+	return rate(caught, caught+broken)
+}
+
+// Fraction of the blocked traffic the rule catches, minus Weight times the fraction of the allowed
+// traffic it breaks.  Weight is how many times worse it is for the adversary to break allowed
+// traffic than to let blocked traffic through.
+type CollateralScorer struct {
+	Weight float64
+}
+
+func (self CollateralScorer) Score(candidate *RuleCandidate) float64 {
+	caught, broken, missed, passed := candidate.Outcomes()
+
+	return math.Max(rate(caught, caught+missed)-(self.Weight*rate(broken, broken+passed)), 0)
+}
+
+// Entropy in bits of a label split into a and b packets.
+func entropy(a int64, b int64) float64 {
+	total := float64(a + b)
+	result := 0.0
+	for _, count := range []int64{a, b} {
+		if count > 0 {
+			p := float64(count) / total
+			result = result - (p * math.Log2(p))
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"math"
+	"testing"
+)
+
+func TestScorers(t *testing.T) {
+	perfect := &RuleCandidate{AllowCount: 0, AllowTotal: 100, BlockCount: 100, BlockTotal: 100}
+	for _, scorer := range []Scorer{DifferenceScorer{}, InformationGainScorer{}, F1Scorer{}, PrecisionScorer{MaxFalsePositiveRate: 0.01}, CollateralScorer{Weight: 1}} {
+		perfect.scorer = scorer
+		if perfect.Score() <= 0 || perfect.Score() > 1 {
+			t.Errorf("%T: wrong score for a perfect rule %f", scorer, perfect.Score())
+		}
+	}
+
+	perfect.scorer = InformationGainScorer{}
+	if math.Abs(perfect.Score()-1) > 1e-9 {
+		t.Error("A perfect rule should give one bit", perfect.Score())
+	}
+	perfect.scorer = F1Scorer{}
+	if perfect.Score() != 1 {
+		t.Error("A perfect rule should have an F1 score of 1", perfect.Score())
+	}
+
+	// An allow rule blocks the packets that don't match it.
+	allow := &RuleCandidate{AllowCount: 90, AllowTotal: 100, BlockCount: 20, BlockTotal: 100}
+	caught, broken, missed, passed := allow.Outcomes()
+	if caught != 80 || broken != 10 || missed != 20 || passed != 90 {
+		t.Error("Wrong outcomes", caught, broken, missed, passed)
+	}
+
+	// Catches most blocked traffic but breaks some allowed traffic, or catches less and breaks none.
+	broad := &RuleCandidate{AllowCount: 10, AllowTotal: 100, BlockCount: 90, BlockTotal: 100}
+	narrow := &RuleCandidate{AllowCount: 0, AllowTotal: 100, BlockCount: 50, BlockTotal: 100}
+
+	broad.scorer, narrow.scorer = CollateralScorer{Weight: 10}, CollateralScorer{Weight: 10}
+	if !narrow.BetterThan(broad) {
+		t.Error("Breaking allowed traffic should cost more than missing blocked traffic", narrow.Score(), broad.Score())
+	}
+	broad.scorer, narrow.scorer = CollateralScorer{Weight: 0.1}, CollateralScorer{Weight: 0.1}
+	if !broad.BetterThan(narrow) {
+		t.Error("Missing blocked traffic should cost more than breaking allowed traffic", narrow.Score(), broad.Score())
+	}
+
+	broad.scorer = PrecisionScorer{MaxFalsePositiveRate: 0.05}
+	if broad.Score() != 0 {
+		t.Error("Expected no score past the false positive rate", broad.Score())
+	}
+	broad.scorer = PrecisionScorer{MaxFalsePositiveRate: 0.2}
+	if broad.Score() != 0.9 {
+		t.Error("Wrong precision", broad.Score())
+	}
+
+	_, err := NewScorer(&DatasetConfig{Scorer: "bogus"})
+	if err == nil {
+		t.Error("Expected an unknown scorer to be rejected")
+	}
+}
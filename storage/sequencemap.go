@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"encoding/binary"
 	"fmt"
 
 	"github.com/Workiva/go-datastructures/trie/ctrie"
@@ -12,11 +13,12 @@ type SequenceMap struct {
 	bytemap *Countmap	// struct including countmap file pointer, best rule, and rule update channel
 }
 
-func NewSequenceMap(name string, updates chan *RuleCandidate) (*SequenceMap, error) {
+func NewSequenceMap(cache *StoreCache, name string, updates chan *RuleCandidate, scorer Scorer) (*SequenceMap, error) {
 	// OpenStore will create files like
 	// store/dataset1-incoming-offsets-sequence/index
 	// store/dataset1-incoming-offsets-sequence/source
-	store, err := OpenStore(name + "-sequence")
+	// The store is shared through the cache with the rule service, which looks up rule sequences in it.
+	store, err := cache.Open(name + "-sequence")
 	if err != nil {
 		return nil, err
 	}
@@ -29,21 +31,81 @@ func NewSequenceMap(name string, updates chan *RuleCandidate) (*SequenceMap, err
 	// (optional) values stored at the trie's "final" nodes. (from Wikipedia)
 	var ctrie *ctrie.Ctrie = ctrie.New(nil)
 	var bytemap *Countmap
-	bytemap, err = NewCountmap(name+"-sequence", updates)
+	bytemap, err = NewCountmap(cache.Root, name+"-sequence", updates, scorer)
 	if err != nil {
 		return nil, err
 	}
 
-	// Puts sequences already in the store into the ctrie. Confused about 0 index.
-	store.BlockingFromIndexDo(0, func(record *Record) {
+	// Countmaps from before version 3 need their packet totals rebuilt from the counts.
+	var totals *packetTotals
+	if bytemap.Legacy() {
+		totals = newPacketTotals()
+	}
+
+	// Puts sequences already in the store into the ctrie, starting with the first one (index 0).
+	store.BlockingFromIndexDo(-1, func(record *Record) {
 		// Insert adds the key-value pair to the Ctrie, replacing the existing value if
 		// the key already exists.
 		ctrie.Insert(record.Data, record)
+
+		if totals != nil {
+			totals.add(record, bytemap)
+		}
 	})
 
+	if totals != nil {
+		allow, block := totals.max()
+		err = bytemap.RebuildTotals(allow, block)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return &SequenceMap{store: store, ctrie: ctrie, bytemap: bytemap}, nil
 }
 
+// Sums of the counts of the sequences with each offset and length.  A packet contains at most one
+// sequence with a given offset and length, so each sum is at most the number of packets, and the
+// sum for the first byte (offset 0, length 1) is the number of non-empty packets.  The largest sum
+// is used as the total.
+type packetTotals struct {
+	sums map[[2]int]*[2]int64 // offset and length to the block and allow sums
+}
+
+func newPacketTotals() *packetTotals {
+	return &packetTotals{sums: make(map[[2]int]*[2]int64)}
+}
+
+// Add the counts of a sequence, which is two bytes of offset followed by the subsequence.
+func (self *packetTotals) add(record *Record, countmap *Countmap) {
+	if len(record.Data) < 3 {
+		return
+	}
+
+	key := [2]int{int(binary.LittleEndian.Uint16(record.Data)), len(record.Data) - 2}
+	sum, ok := self.sums[key]
+	if !ok {
+		sum = &[2]int64{}
+		self.sums[key] = sum
+	}
+
+	sum[0] += countmap.GetCount(record.Index, false)
+	sum[1] += countmap.GetCount(record.Index, true)
+}
+
+func (self *packetTotals) max() (allow int64, block int64) {
+	for _, sum := range self.sums {
+		if sum[0] > block {
+			block = sum[0]
+		}
+		if sum[1] > allow {
+			allow = sum[1]
+		}
+	}
+
+	return allow, block
+}
+
 // The sequence contains the offset (first two bytes) and the subpayload (beginning at the offset and of
 // variable length).
 func (self *SequenceMap) Increment(allowBlock bool, sequence []byte) {
@@ -58,39 +120,89 @@ func (self *SequenceMap) Increment(allowBlock bool, sequence []byte) {
 		// files). The index file is needed because the offset/subsequence combo may have variable length.
 		// The purpose of the store is to associate an offset/subsequence combo with an index that is then
 		// used in the countmap file to determine how many times this offset/subsequence combo has been
-		// seen for allow/block.
-		index := self.store.Add(sequence)
+		// seen for allow/block.  It's buffered until the whole packet has been processed, so the
+		// store is synced once per packet rather than once per subsequence.
+		index := self.store.AddBuffered(sequence)
 		if index == -1 {
 			fmt.Println("Error adding sequence to store", len(sequence), sequence)
 			return
 		}
 		//		fmt.Println("Added sequence", self.store.Path, len(sequence), "got index", index)
-		record, err := self.store.GetRecord(index)	// Attempt to retrieve the just-added sequence
-		if err != nil {
-			fmt.Println("Error adding record")
-			return
-		}
-		if len(record.Data) == 0 {
-			fmt.Println("Error, added sequence now has 0 length")
-			return
-		}
-		if record.Index != index {
-			fmt.Println("Error, record has incorrect index")
-			return
-		}
+		record := &Record{Index: index, Data: sequence}
 
 		self.bytemap.IncrementCount(index, allowBlock)
 		self.ctrie.Insert(sequence, record)
 	}
 }
 
+// Count a training packet in the allow/block totals.  Called once per packet, before the
+// sequences in it are incremented.
+func (self *SequenceMap) CountPacket(allowBlock bool) {
+	self.bytemap.IncrementTotal(allowBlock)
+}
+
 // not used
 func (self *SequenceMap) ProcessBytes(allowBlock bool, sequence []byte) {
+	self.CountPacket(allowBlock)
 	for length := 1; length <= len(sequence); length++ {
 		for offset := 0; offset+length <= len(sequence); offset++ {
 			self.Increment(allowBlock, sequence[offset:offset+length])
 		}
 	}
 
-	self.bytemap.Save()
+	self.Sync()
+}
+
+// Write the sequences added since the last packet to the store.
+func (self *SequenceMap) Sync() {
+	err := self.store.Sync()
+	if err != nil {
+		fmt.Println("Error saving sequences", err)
+	}
+}
+
+// The best rule candidates, best first.
+func (self *SequenceMap) Top() []*RuleCandidate {
+	return self.bytemap.Top.Candidates()
+}
+
+// The sequence that a rule candidate's index refers to.
+func (self *SequenceMap) Sequence(index int64) ([]byte, error) {
+	record, err := self.store.GetRecord(index)
+	if err != nil {
+		return nil, err
+	}
+
+	return record.Data, nil
+}
+
+// Index of the last training record included in the counts, -1 if none have been.
+func (self *SequenceMap) Last() int64 {
+	return self.bytemap.Last()
+}
+
+// Record that the training record at index has been processed.  The counts are flushed
+// to disk in batches, along with the index of the last record they include.
+func (self *SequenceMap) Checkpoint(index int64) error {
+	// The counts refer to the sequences by index, so the sequences go to disk first.
+	err := self.store.Sync()
+	if err != nil {
+		return err
+	}
+
+	return self.bytemap.Checkpoint(index)
+}
+
+// Flush any counts that haven't been written to disk yet.
+func (self *SequenceMap) Flush() error {
+	err := self.store.Sync()
+	if err != nil {
+		return err
+	}
+
+	if !self.bytemap.Pending() {
+		return nil
+	}
+
+	return self.bytemap.Flush()
 }
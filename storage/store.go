@@ -1,36 +1,43 @@
 package storage
 
 import (
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"sync"
 )
 
 type Record struct {
 	Index int64
 	Data  []byte
+	Meta  *RecordMeta	// label, direction, timestamp and connection; nil if the record was added without them
 }
 
 type Store struct {
 	Path                   string		// something like "dataset1-incoming"
+	Recovered              *RecoveryReport	// what was dropped from the end of the store when it was opened, nil if nothing
+	root                   *Root		// lab directory that contains the store
+	format                 indexFormat	// layout of the index file
 	outindex               *os.File		// index file that records index -> index/offset/length info
 	output                 *os.File		// source file that records data concatenated together
+	meta                   *os.File		// meta file that records index -> label/direction/timestamp/connection, nil if unused
 	last                   int64		// the index of the last record stored (should be equal to #packets)
 	expectedOutputLength   int64		// number of bytes in the source file
 	expectedOutindexLength int64		// number of bytes in the index file
+	pending                [][]byte		// records added with AddBuffered that haven't been written yet
+	lock                   sync.Mutex	// for pending and last, since other goroutines read records while they're added
 }
 
 // Creates index and source files in a store/path directory.
-func OpenStore(path string) (*Store, error) {
+func OpenStore(root *Root, path string) (*Store, error) {
 	//	fmt.Println("OPEN STORE", path)
 	// Creates the store and path directories if they don't already exist.
-	os.Mkdir("store", 0777)
-	os.Mkdir("store/"+path, 0777)
+	os.Mkdir(root.Path, 0777)
+	os.Mkdir(root.Dir(path), 0777)
 
 	// Create an index file.
-	outindex, err := os.OpenFile("store/"+path+"/index", os.O_APPEND|os.O_RDWR|os.O_CREATE|os.O_SYNC, 0666)
+	outindex, err := os.OpenFile(root.File(path, "index"), os.O_APPEND|os.O_RDWR|os.O_CREATE|os.O_SYNC, 0666)
 	if err != nil {
 		return nil, err
 	}
@@ -44,8 +51,23 @@ func OpenStore(path string) (*Store, error) {
 		return nil, err
 	}
 
+	// Stores created before checksums were added keep using the version 1 layout.
+	format, err := detectIndexFormat(outindex, eoil)
+	if err != nil {
+		return nil, err
+	}
+	if eoil < format.headerSize {
+		// New store, or the header of a new store was torn.
+		outindex.Truncate(0)
+		_, err = outindex.Write(format.header())
+		if err != nil {
+			return nil, err
+		}
+		eoil = format.headerSize
+	}
+
 	// Create a source file.
-	output, err2 := os.OpenFile("store/"+path+"/source", os.O_APPEND|os.O_RDWR|os.O_CREATE|os.O_SYNC, 0666)
+	output, err2 := os.OpenFile(root.File(path, "source"), os.O_APPEND|os.O_RDWR|os.O_CREATE|os.O_SYNC, 0666)
 	if err2 != nil {
 		return nil, err2
 	}
@@ -55,9 +77,24 @@ func OpenStore(path string) (*Store, error) {
 		return nil, err3
 	}
 
-	store := &Store{Path: path, outindex: outindex, output: output, last: -1, expectedOutputLength: eol, expectedOutindexLength: eoil}
+	// Open the meta file, which only exists if records have been added with metadata.
+	meta, err4 := openMeta(root.File(path, "meta"))
+	if err4 != nil {
+		return nil, err4
+	}
+
+	store := &Store{Path: path, root: root, format: format, outindex: outindex, output: output, meta: meta, last: -1, expectedOutputLength: eol, expectedOutindexLength: eoil}
+
+	// Drop anything at the end of the files that was never committed, such as after a crash.
+	store.Recovered, err = store.recover()
+	if err != nil {
+		return nil, err
+	}
+	if store.Recovered != nil {
+		fmt.Println("Recovered store", path, store.Recovered)
+	}
+
 	//	fmt.Println("verifying", path)
-	// FIXME - fix the problems that cause verification to fail
 	err = store.Verify()
 	if err != nil {
 		return nil, err
@@ -68,12 +105,8 @@ func OpenStore(path string) (*Store, error) {
 
 // Make sure the index file is set up properly.
 func (self *Store) Verify() error {
-	imax, err := self.outindex.Seek(0, io.SeekEnd)
-	if err != nil {
-		return err
-	}
 	// If the index file is empty, return no error.
-	max := int64(imax) / storeCellByteSize
+	max := self.format.count(self.expectedOutindexLength)
 	if max == 0 {
 		return nil
 	}
@@ -81,14 +114,14 @@ func (self *Store) Verify() error {
 	// Check that indices recorded for each section in the index file increment by 1.
 	var current int64
 	for current = 0; current < max; current++ {
-		value, err := self.getIndex(current)
+		cell, err := self.format.readCell(self.outindex, current)
 		if err != nil {
 			return err
 		}
 
-		if value != current {
-			fmt.Println("invalid: found", value, "expected:", current, max)
-			return errors.New("...Store verification failed: Invalid index " + string(value) + " " + string(current))
+		if cell.Index != current {
+			fmt.Println("invalid: found", cell.Index, "expected:", current, max)
+			return fmt.Errorf("...Store verification failed: Invalid index %d %d", cell.Index, current)
 		}
 
 		//fmt.Println("Verified", value, current, max)
@@ -101,83 +134,65 @@ func (self *Store) Verify() error {
 	return nil
 }
 
-// storeCellByteSize is 24 because the information for each index takes up 24 bytes
-// (8 for index, 8 for offset, 8 for length).
-func (self *Store) getIndex(index int64) (int64, error) {
-	return self.getInt64((index * storeCellByteSize) + indexStoreCellOffset)
-}
-
-func (self *Store) getOffset(index int64) (int64, error) {
-	return self.getInt64((index * storeCellByteSize) + offsetStoreCellOffset)
-}
-
-func (self *Store) getLength(index int64) (int64, error) {
-	return self.getInt64((index * storeCellByteSize) + lengthStoreCellOffset)
-}
-
-// Get the encoded int64 at the given byte position in the index file.  The encoded
-// int64 should take up 8 bytes in the index file.
-func (self *Store) getInt64(index int64) (int64, error) {
-	bs := make([]byte, int64Size)
-	_, err := self.outindex.Seek(index, io.SeekStart)
-	if err != nil {
-		fmt.Println("Error in getInt64 Seek", err)
-		return -1, err
-	}
-	_, err2 := self.outindex.Read(bs)
-	if err2 != nil {
-		fmt.Println("Error in getInt64 Read", self.Path, index)
-		return -1, err2
+// Get the Record at a given index (0-indexed) in the source file by
+// looking up the offset and length for that index from the corresponding
+// index file.
+func (self *Store) GetRecord(index int64) (*Record, error) {
+	self.lock.Lock()
+	if index > self.last && index <= self.last+int64(len(self.pending)) {
+		data := self.pending[index-self.last-1]
+		self.lock.Unlock()
+		return &Record{Index: index, Data: data}, nil
 	}
-	value, _ := binary.Varint(bs)
+	self.lock.Unlock()
 
-	if Debug {
-		fmt.Println("getInt64", index, len(bs), bs)
+	var meta io.ReaderAt
+	if self.meta != nil {
+		meta = self.meta
 	}
 
-	return value, nil
+	return readRecord(self.format, self.outindex, self.output, meta, index)
 }
 
-// Get the Record at a given index (0-indexed) in the source file by
-// looking up the offset and length for that index from the corresponding
-// index file.
-func (self *Store) GetRecord(index int64) (*Record, error) {
-	var offset int64
-	var length int64
+// Read the Record at a given index from a store's files.  meta is nil if the store has no meta file.
+func readRecord(format indexFormat, outindex io.ReaderAt, output io.ReaderAt, metafile io.ReaderAt, index int64) (*Record, error) {
+	var cell *indexCell
 	var err error
 	var bs []byte
 
-	offset, err = self.getOffset(index)
+	cell, err = format.readCell(outindex, index)
 	if err != nil {
-		fmt.Println("Error in GetRecord - getOffset", index)
+		fmt.Println("Error in GetRecord - readCell", index)
 		return nil, err
 	}
 
-	length, err = self.getLength(index)
-	if err != nil {
-		fmt.Println("Error in GetRecord - getLength", index)
-		return nil, err
+	if cell.Length == 0 {
+		fmt.Println("Error, zero length sequence", index, cell.Offset, cell.Length)
+		return nil, errors.New("Error, zero length sequence")
 	}
 
-	bs = make([]byte, length)
-	_, err = self.output.Seek(offset, os.SEEK_SET)
+	bs = make([]byte, cell.Length)
+	_, err = output.ReadAt(bs, cell.Offset)
 	if err != nil {
-		fmt.Println("Error in GetRecord - Seek", offset)
+		fmt.Println("Error in GetRecord - Read", cell.Offset)
 		return nil, err
 	}
 
-	_, err = self.output.Read(bs)
-	if err != nil {
-		fmt.Println("Error in GetRecord - Read", offset)
-		return nil, err
+	if !format.checkData(cell, bs) {
+		fmt.Println("Error, checksum mismatch", index, cell.Offset, cell.Length)
+		return nil, errors.New("Error, record checksum mismatch")
 	}
 
-	if length == 0 || len(bs) == 0 {
-		fmt.Println("Error, zero length sequence", index, offset, length, len(bs), bs)
-		return nil, errors.New("Error, zero length sequence")
+	var meta *RecordMeta
+	if metafile != nil {
+		meta, err = getMeta(metafile, index)
+		if err != nil {
+			fmt.Println("Error in GetRecord - getMeta", index)
+			return nil, err
+		}
 	}
 
-	return &Record{Index: index, Data: bs}, nil
+	return &Record{Index: index, Data: bs, Meta: meta}, nil
 }
 
 // Returns the index of the last section of recorded data.
@@ -188,6 +203,12 @@ func (self *Store) LastIndex() int64 {
 // Add a byte array to the source file and add the index/offset/length information
 // to the index file.
 func (self *Store) Add(data []byte) int64 {
+	return self.AddRecord(data, nil)
+}
+
+// Add a byte array along with its label, direction, timestamp and connection.  The metadata
+// is recorded in the meta file, which is created the first time metadata is added.
+func (self *Store) AddRecord(data []byte, meta *RecordMeta) int64 {
 	if len(data) == 0 {
 		fmt.Println("Cannot add sequence with 0 length")
 		return -1
@@ -197,6 +218,11 @@ func (self *Store) Add(data []byte) int64 {
 		fmt.Println("Adding to store", self, self.Path, self.last)
 	}
 
+	// Buffered records come first.
+	if self.Sync() != nil {
+		return -1
+	}
+
 	index := self.last + 1
 
 	// stat, err := self.output.Stat()
@@ -210,57 +236,167 @@ func (self *Store) Add(data []byte) int64 {
 
 	//	fmt.Println("Adding", offset, length, offset+length)
 
-	self.output.Write(data)
-	self.output.Sync()	// commit the written data to disk
+	// The record is committed in three steps: the data is synced to the source file, then
+	// the metadata to the meta file, then the cell to the index file.  A crash before the
+	// cell is complete leaves uncommitted bytes that are dropped the next time the store is opened.
+	_, err := self.output.Write(data)
+	if err == nil {
+		err = self.output.Sync()	// commit the written data to disk
+	}
+	if err != nil {
+		fmt.Println("Error writing source", err)
+		self.output.Truncate(offset)
+		return -1
+	}
 	self.expectedOutputLength = self.expectedOutputLength + length
 
+	// Record the metadata before the index so that an indexed record always has its metadata.
+	if meta != nil && self.meta == nil {
+		file, err := createMeta(self.root.File(self.Path, "meta"), index)
+		if err != nil {
+			fmt.Println("Error creating meta file", err)
+			return -1
+		}
+		self.meta = file
+	}
+	if self.meta != nil {
+		err := putMeta(self.meta, index, meta)
+		if err != nil {
+			fmt.Println("Error writing meta", err)
+			return -1
+		}
+	}
+
 	// Also record the index/offset/length information in the index file so can retrieve the
 	// information from the source file later.
-	self.AddIndex(index, offset, length)
+	err = self.AddIndex(index, offset, length, self.format.checksum(data))
+	if err != nil {
+		fmt.Println("Error writing index", err)
+		return -1
+	}
 
 	return self.last
 }
 
+// Add a byte array without writing it to disk yet, returning its index.  The record can be read
+// right away, but it is only committed when Sync is called.  This saves syncing the files for
+// every record when many small ones are added at once, like the subsequences of a packet.
+func (self *Store) AddBuffered(data []byte) int64 {
+	if len(data) == 0 {
+		fmt.Println("Cannot add sequence with 0 length")
+		return -1
+	}
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	self.pending = append(self.pending, append([]byte(nil), data...))
+	return self.last + int64(len(self.pending))
+}
+
+// Write and commit the records added with AddBuffered, syncing each file once for all of them.
+// If writing fails, the records stay buffered so that a later Sync can try again.
+func (self *Store) Sync() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if len(self.pending) == 0 {
+		return nil
+	}
+
+	// Same order as AddRecord: data, then metadata, then the index cells that commit it.
+	var source []byte
+	var cells []byte
+	offset := self.expectedOutputLength
+	for i, data := range self.pending {
+		index := self.last + 1 + int64(i)
+		source = append(source, data...)
+		cells = append(cells, self.format.encodeCell(indexCell{Index: index, Offset: offset, Length: int64(len(data)), Checksum: self.format.checksum(data)})...)
+		offset = offset + int64(len(data))
+	}
+
+	_, err := self.output.Write(source)
+	if err == nil {
+		err = self.output.Sync()
+	}
+	if err != nil {
+		fmt.Println("Error writing source", err)
+		self.output.Truncate(self.expectedOutputLength)
+		return err
+	}
+
+	if self.meta != nil {
+		for i := range self.pending {
+			err = putMeta(self.meta, self.last+1+int64(i), nil)
+			if err != nil {
+				fmt.Println("Error writing meta", err)
+				self.output.Truncate(self.expectedOutputLength)
+				return err
+			}
+		}
+	}
+
+	_, err = self.outindex.Write(cells)
+	if err == nil {
+		err = self.outindex.Sync()
+	}
+	if err != nil {
+		fmt.Println("Error writing index", err)
+		self.outindex.Truncate(self.expectedOutindexLength)
+		self.output.Truncate(self.expectedOutputLength)
+		return err
+	}
+
+	self.last = self.last + int64(len(self.pending))
+	self.expectedOutputLength = offset
+	self.expectedOutindexLength = self.expectedOutindexLength + int64(len(cells))
+	self.pending = nil
+
+	return nil
+}
+
 // index is the index (0-indexed) of the newly added data to the store/path/source. offset is the
 // byte index at which the data start, and length is the number of bytes of data that was added.
-// This function records the index, offset, and length, in that order, each with 8 bytes in the
+// This function records the index, offset, length and checksum of the data as one cell in the
 // index file and updates the last and expectedOutindexLength keys for the store.
-func (self *Store) AddIndex(index int64, offset int64, length int64) {
+func (self *Store) AddIndex(index int64, offset int64, length int64, checksum uint32) error {
 	if length == 0 {
 		fmt.Println("Cannot add sequence with 0 length")
-		return
+		return errors.New("Cannot add sequence with 0 length")
 	}
 
 	if Debug {
 		fmt.Println("Adding to store index", index, offset, length, self.last)
 	}
-	self.last = index	// updates the last index (this newly added packet)
-	//	fmt.Println("Last:", self.last)
 
 	ioffset := self.expectedOutindexLength
 
-	// this should never happen
-	if ioffset%(storeCellByteSize) != 0 {
-		// FIXME - reduce index and last
-		roundedSize := (ioffset / storeCellByteSize) * storeCellByteSize
-		fmt.Println("Truncating index", ioffset, storeCellByteSize, ioffset%storeCellByteSize, roundedSize)
+	// this should never happen, since partial cells are dropped when the store is opened
+	if (ioffset-self.format.headerSize)%self.format.cellSize != 0 {
+		roundedSize := self.format.cellOffset(self.format.count(ioffset))
+		fmt.Println("Truncating index", ioffset, self.format.cellSize, roundedSize)
 		self.outindex.Truncate(roundedSize)
+		ioffset = roundedSize
 	}
 
-	data := make([]byte, int64Size)
-
-	binary.PutVarint(data, index)
-	self.outindex.Write(data)
-
-	binary.PutVarint(data, offset)
-	self.outindex.Write(data)
-
-	binary.PutVarint(data, length)
-	self.outindex.Write(data)
+	// Write the whole cell at once so that it is either all there or detectably torn.
+	data := self.format.encodeCell(indexCell{Index: index, Offset: offset, Length: length, Checksum: checksum})
+	_, err := self.outindex.Write(data)
+	if err == nil {
+		err = self.outindex.Sync()
+	}
+	if err != nil {
+		self.outindex.Truncate(ioffset)
+		return err
+	}
 
-	self.outindex.Sync()
+	self.lock.Lock()
+	self.last = index	// updates the last index (this newly added packet)
+	self.lock.Unlock()
+	//	fmt.Println("Last:", self.last)
+	self.expectedOutindexLength = ioffset + self.format.cellSize
 
-	self.expectedOutindexLength = self.expectedOutindexLength + storeCellByteSize
+	return nil
 }
 
 func (self *Store) FromIndexDo(index int64, channel chan *Record) {
@@ -289,6 +425,14 @@ func (self *Store) BlockingFromIndexDo(index int64, handle func(*Record)) {
 }
 
 func (self *Store) Close() {
+	err := self.Sync()
+	if err != nil {
+		fmt.Println("Error writing buffered records", err)
+	}
+
 	self.outindex.Close()
 	self.output.Close()
+	if self.meta != nil {
+		self.meta.Close()
+	}
 }
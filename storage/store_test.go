@@ -1,62 +1,492 @@
 package storage
 
-import "testing"
-
-// func TestAdd(t *testing.T) {
-// 	runtime.GOMAXPROCS(runtime.NumCPU())
-//
-// 	store, err := OpenStore("testing")
-// 	if err != nil {
-// 		fmt.Println("Error opening store")
-// 		fmt.Println(err)
-// 		t.Error(err)
-// 	}
-//
-// 	for i := 0; i < 100; i++ {
-// 		bs := make([]byte, 100)
-// 		store.Add(bs)
-// 	}
-//
-// 	store.Close()
-//
-// 	store, err = OpenStore("testing")
-// 	if err != nil {
-// 		fmt.Println("Error opening store")
-// 		fmt.Println(err)
-// 		t.Error(err)
-// 	}
-// }
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// Opens a Root in a new temporary directory so tests don't touch the lab in ./store
+func testRoot(t *testing.T) *Root {
+	path, err := ioutil.TempDir("", "adversarylab")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := NewRoot(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return root
+}
+
+func TestAdd(t *testing.T) {
+	root := testRoot(t)
+	defer os.RemoveAll(root.Path)
+
+	store, err := OpenStore(root, "testing")
+	if err != nil {
+		t.Fatal("Error opening store", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		bs := make([]byte, 100)
+		bs[0] = byte(i)
+		store.Add(bs)
+	}
+
+	store.Close()
+
+	store, err = OpenStore(root, "testing")
+	if err != nil {
+		t.Fatal("Error reopening store", err)
+	}
+	defer store.Close()
+
+	if store.LastIndex() != 99 {
+		t.Fatal("Wrong last index", store.LastIndex())
+	}
+
+	record, err := store.GetRecord(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Data[0] != 42 || record.Meta != nil {
+		t.Error("Wrong record", record)
+	}
+}
+
+func TestAddBuffered(t *testing.T) {
+	root := testRoot(t)
+	defer os.RemoveAll(root.Path)
+
+	store, err := OpenStore(root, "testing")
+	if err != nil {
+		t.Fatal("Error opening store", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if store.AddBuffered([]byte{byte(i), 1}) != int64(i) {
+			t.Error("Wrong index for buffered record", i)
+		}
+	}
+
+	// Buffered records can be read before they are written.
+	record, err := store.GetRecord(1)
+	if err != nil || record.Data[0] != 1 {
+		t.Error("Wrong buffered record", record, err)
+	}
+	if store.LastIndex() != -1 {
+		t.Error("Buffered records shouldn't be committed yet", store.LastIndex())
+	}
+
+	err = store.Sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.LastIndex() != 2 {
+		t.Error("Wrong last index after sync", store.LastIndex())
+	}
+
+	// Records added directly go after the buffered ones.
+	store.AddBuffered([]byte{3, 1})
+	if store.Add([]byte{4, 1}) != 4 {
+		t.Error("Wrong index after buffered records")
+	}
+	store.Close()
+
+	store, err = OpenStore(root, "testing")
+	if err != nil {
+		t.Fatal("Error reopening store", err)
+	}
+	defer store.Close()
+
+	if store.LastIndex() != 4 || store.Recovered != nil {
+		t.Error("Wrong store after reopening", store.LastIndex(), store.Recovered)
+	}
+	for i := int64(0); i < 5; i++ {
+		record, err = store.GetRecord(i)
+		if err != nil || record.Data[0] != byte(i) {
+			t.Error("Wrong record", i, record, err)
+		}
+	}
+}
+
+func TestRecover(t *testing.T) {
+	root := testRoot(t)
+	defer os.RemoveAll(root.Path)
+
+	store, err := OpenStore(root, "testing-incoming")
+	if err != nil {
+		t.Fatal("Error opening store", err)
+	}
+	for i := 0; i < 10; i++ {
+		store.AddRecord([]byte{byte(i), 1, 2, 3}, &RecordMeta{AllowBlock: true})
+	}
+	store.Close()
+
+	// Simulate a crash while adding one more record: the data and metadata made it to disk,
+	// but only part of the index cell did.
+	appendBytes(t, root.File("testing-incoming", "source"), []byte{10, 1, 2, 3})
+	appendBytes(t, root.File("testing-incoming", "meta"), make([]byte, metaCellSize))
+	appendBytes(t, root.File("testing-incoming", "index"), []byte{20, 0, 0})
+
+	store, err = OpenStore(root, "testing-incoming")
+	if err != nil {
+		t.Fatal("Error reopening store after crash", err)
+	}
+	if store.LastIndex() != 9 {
+		t.Error("Wrong last index", store.LastIndex())
+	}
+	expected := RecoveryReport{DroppedRecords: 0, DroppedIndexBytes: 3, DroppedSourceBytes: 4, DroppedMetaBytes: metaCellSize}
+	if store.Recovered == nil || *store.Recovered != expected {
+		t.Error("Wrong recovery report", store.Recovered)
+	}
+
+	// The store can be added to after recovering.
+	if store.AddRecord([]byte{10, 1, 2, 3}, &RecordMeta{AllowBlock: false}) != 10 {
+		t.Error("Wrong index after recovery")
+	}
+	store.Close()
+
+	// Damage the data of the last record, which makes it fail its checksum.
+	source, err := os.OpenFile(root.File("testing-incoming", "source"), os.O_RDWR, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stat, _ := source.Stat()
+	source.WriteAt([]byte{99}, stat.Size()-1)
+	source.Close()
+
+	store, err = OpenStore(root, "testing-incoming")
+	if err != nil {
+		t.Fatal("Error reopening store after damage", err)
+	}
+	defer store.Close()
+
+	if store.LastIndex() != 9 {
+		t.Error("Wrong last index", store.LastIndex())
+	}
+	if store.Recovered == nil || store.Recovered.DroppedRecords != 1 {
+		t.Error("Wrong recovery report", store.Recovered)
+	}
+
+	record, err := store.GetRecord(9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Data[0] != 9 || record.Meta == nil || !record.Meta.AllowBlock {
+		t.Error("Wrong record", record)
+	}
+}
+
+func TestRecoverMeta(t *testing.T) {
+	root := testRoot(t)
+	defer os.RemoveAll(root.Path)
+
+	store, err := OpenStore(root, "testing-incoming")
+	if err != nil {
+		t.Fatal("Error opening store", err)
+	}
+	for i := 0; i < 3; i++ {
+		store.AddRecord([]byte{byte(i), 1, 2, 3}, &RecordMeta{AllowBlock: true})
+	}
+	store.Close()
+
+	// Lose the last cell and a half, as if the meta file hadn't made it to disk.
+	metaPath := root.File("testing-incoming", "meta")
+	os.Truncate(metaPath, metaHeaderSize+metaCellSize+5)
+
+	store, err = OpenStore(root, "testing-incoming")
+	if err != nil {
+		t.Fatal("Error reopening store with a short meta file", err)
+	}
+	if store.LastIndex() != 2 {
+		t.Error("Wrong last index", store.LastIndex())
+	}
+	expected := RecoveryReport{PaddedMetaBytes: metaCellSize*2 - 5}
+	if store.Recovered == nil || *store.Recovered != expected {
+		t.Error("Wrong recovery report", store.Recovered)
+	}
+
+	record, err := store.GetRecord(0)
+	if err != nil || record.Meta == nil || !record.Meta.AllowBlock {
+		t.Error("Wrong record", record, err)
+	}
+	for i := int64(1); i < 3; i++ {
+		record, err = store.GetRecord(i)
+		if err != nil || record.Meta != nil {
+			t.Error("Missing metadata should read as unlabeled", record, err)
+		}
+	}
+	store.Close()
+
+	// Tear the header, as if the server crashed while the meta file was being created.
+	ioutil.WriteFile(metaPath, []byte(metaMagic[:3]), 0666)
+
+	store, err = OpenStore(root, "testing-incoming")
+	if err != nil {
+		t.Fatal("Error reopening store with a torn meta header", err)
+	}
+	defer store.Close()
+
+	expected = RecoveryReport{PaddedMetaBytes: metaHeaderSize + metaCellSize*3 - 3}
+	if store.Recovered == nil || *store.Recovered != expected {
+		t.Error("Wrong recovery report", store.Recovered)
+	}
+
+	record, err = store.GetRecord(2)
+	if err != nil || record.Data[0] != 2 || record.Meta != nil {
+		t.Error("Wrong record", record, err)
+	}
+
+	if store.AddRecord([]byte{3, 1, 2, 3}, &RecordMeta{Incoming: true}) != 3 {
+		t.Error("Wrong index after recovery")
+	}
+	record, err = store.GetRecord(3)
+	if err != nil || record.Meta == nil || !record.Meta.Incoming {
+		t.Error("Wrong record", record, err)
+	}
+}
+
+func TestTornIndexHeader(t *testing.T) {
+	root := testRoot(t)
+	defer os.RemoveAll(root.Path)
+
+	// A crash while a new store was being created can leave the start of its header.
+	os.Mkdir(root.Dir("testing"), 0777)
+	ioutil.WriteFile(root.File("testing", "index"), []byte(indexMagic[:2]), 0666)
+
+	store, err := OpenStore(root, "testing")
+	if err != nil {
+		t.Fatal("Error opening store with a torn header", err)
+	}
+	defer store.Close()
+
+	if store.format.version != indexFormatV2.version {
+		t.Error("Wrong index format", store.format.version)
+	}
+	if store.Add([]byte{1, 2, 3}) != 0 {
+		t.Error("Wrong index")
+	}
+}
+
+func TestReadonlyStore(t *testing.T) {
+	root := testRoot(t)
+	defer os.RemoveAll(root.Path)
+
+	store, err := OpenStore(root, "testing-incoming")
+	if err != nil {
+		t.Fatal("Error opening store", err)
+	}
+	defer store.Close()
+
+	for i := 0; i < 5; i++ {
+		store.AddRecord([]byte{byte(i), 1, 2, 3}, &RecordMeta{Incoming: true, Connection: uint64(i)})
+	}
+
+	// A record that is in the middle of being added isn't visible.
+	appendBytes(t, root.File("testing-incoming", "source"), []byte{5, 1, 2, 3})
+	appendBytes(t, root.File("testing-incoming", "index"), []byte{10, 0})
+
+	readonly, err := OpenReadonlyStore(root, "testing-incoming")
+	if err != nil {
+		t.Fatal("Error opening read-only store", err)
+	}
+	defer readonly.Close()
+
+	if readonly.LastIndex() != 4 {
+		t.Error("Wrong last index", readonly.LastIndex())
+	}
+
+	var count int64
+	readonly.BlockingFromIndexDo(-1, func(record *Record) {
+		if record.Index != count || record.Data[0] != byte(count) || record.Meta == nil || record.Meta.Connection != uint64(count) {
+			t.Error("Wrong record", record)
+		}
+		count++
+	})
+	if count != 5 {
+		t.Error("Wrong number of records", count)
+	}
+
+	_, err = readonly.GetRecord(5)
+	if err == nil {
+		t.Error("Expected an error for an uncommitted record")
+	}
+}
+
+func appendBytes(t *testing.T, path string, data []byte) {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	_, err = file.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestListDatasets(t *testing.T) {
+	root := testRoot(t)
+	defer os.RemoveAll(root.Path)
+
+	cache := NewStoreCache(root)
+	cache.Open("testing-incoming")
+	cache.Open("testing-incoming-offsets-sequence")
+
+	names, err := root.ListDatasets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != "testing-incoming" {
+		t.Error("Wrong datasets", names)
+	}
+
+	// Each root is independent of the others.
+	other := testRoot(t)
+	defer os.RemoveAll(other.Path)
+
+	names, err = other.ListDatasets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 0 {
+		t.Error("Expected no datasets", names)
+	}
+}
 
 func TestBytemap(t *testing.T) {
-	t.Log("TestBytemap")
-	// bytemap, err := NewBytemap("HTTP-testing")
-	// t.Log("Loaded")
-	// if err != nil {
-	// 	t.Error("Error opening bytemap file " + err.Error())
-	// }
-	//
-	// counter := 0
-	// for i := 0; i < 1500; i++ {
-	// 	for j := 0; j < 256; j++ {
-	// 		for k := 0; k < 256; k++ {
-	// 			t.Log("->")
-	// 			bytemap.PutCount(i, byte(j), byte(k), int64(counter))
-	// 			counter++
-	// 		}
-	// 	}
-	// }
-	//
-	// counter = 0
-	// for i := 0; i < 1500; i++ {
-	// 	for j := 0; j < 256; j++ {
-	// 		for k := 0; k < 256; k++ {
-	// 			t.Log("<-")
-	// 			observed := bytemap.GetCount(i, byte(j), byte(k))
-	// 			if observed != int64(counter) {
-	// 				t.Fail()
-	// 			}
-	// 			counter++
-	// 		}
-	// 	}
-	// }
+	root := testRoot(t)
+	defer os.RemoveAll(root.Path)
+	os.Mkdir(root.Dir("HTTP-testing"), 0777)
+
+	bytemap, err := NewBytemap(root, "HTTP-testing")
+	if err != nil {
+		t.Fatal("Error opening bytemap file " + err.Error())
+	}
+
+	counter := 1
+	for i := 0; i < 15; i++ {
+		for j := 0; j < 256; j += 17 {
+			for k := 0; k < 256; k += 13 {
+				bytemap.PutCount(i, byte(j), byte(k), int64(counter))
+				counter++
+			}
+		}
+	}
+
+	// Three records that agree on the first three bytes
+	bytemap.ProcessBytes(&Record{Index: 1, Data: []byte("GET /")})
+	bytemap.ProcessBytes(&Record{Index: 2, Data: []byte("GET /index.html")})
+	bytemap.ProcessBytes(&Record{Index: 3, Data: []byte("GEM")})
+	bytemap.Save()
+
+	bytemap, err = NewReadonlyBytemap(root, "HTTP-testing")
+	if err != nil {
+		t.Fatal("Error reopening bytemap file " + err.Error())
+	}
+
+	counter = 1
+	for i := 0; i < 15; i++ {
+		for j := 0; j < 256; j += 17 {
+			for k := 0; k < 256; k += 13 {
+				observed := bytemap.GetCount(i, byte(j), byte(k))
+				if observed != int64(counter) {
+					t.Fatal("Wrong count", i, j, k, observed, counter)
+				}
+				counter++
+			}
+		}
+	}
+
+	if bytemap.GetCount(0, 0, 'G') != 3 || bytemap.GetCount(3, 'T', ' ') != 2 {
+		t.Error("Wrong counts for records")
+	}
+	if bytemap.GetIndex() != 3 {
+		t.Error("Wrong index", bytemap.GetIndex())
+	}
+	if bytemap.GetTotal(2, 'E') != 3 {
+		t.Error("Wrong total", bytemap.GetTotal(2, 'E'))
+	}
+	found, next, count := bytemap.GetMax(2, 'E')
+	if !found || next != 'T' || count != 2 {
+		t.Error("Wrong max", found, next, count)
+	}
+}
+
+func TestBytemapDense(t *testing.T) {
+	root := testRoot(t)
+	defer os.RemoveAll(root.Path)
+	os.Mkdir(root.Dir("HTTP-testing"), 0777)
+
+	// An old dense bytemap with an index of 7 and counts for the first two positions.
+	blocksize := int64(256 * 256 * 8)
+	dense := make([]byte, 8+(2*blocksize))
+	binary.PutVarint(dense[0:], 7)
+	binary.PutVarint(dense[8+(0*256+'A')*8:], 3)
+	binary.PutVarint(dense[8+(0*256+'B')*8:], 1)
+	binary.PutVarint(dense[8+blocksize+('A'*256+'C')*8:], 3)
+	ioutil.WriteFile(root.File("HTTP-testing", "bytemap"), dense, 0666)
+
+	bytemap, err := NewBytemap(root, "HTTP-testing")
+	if err != nil {
+		t.Fatal("Error opening bytemap file " + err.Error())
+	}
+
+	if bytemap.GetIndex() != 7 || bytemap.GetCount(0, 0, 'A') != 3 || bytemap.GetCount(0, 0, 'B') != 1 || bytemap.GetCount(1, 'A', 'C') != 3 {
+		t.Error("Wrong counts after conversion")
+	}
+	if !bytes.Equal(bytemap.Extract(), []byte("AC")) {
+		t.Error("Wrong prefix", bytemap.Extract())
+	}
+
+	stat, err := os.Stat(root.File("HTTP-testing", "bytemap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Size() != bytemapHeaderSize+(3*bytemapEntrySize) {
+		t.Error("Bytemap was not converted", stat.Size())
+	}
+}
+
+func TestBytemapFile(t *testing.T) {
+	root := testRoot(t)
+	defer os.RemoveAll(root.Path)
+	os.Mkdir(root.Dir("HTTP-testing"), 0777)
+
+	bytemap, err := NewBytemapFile(root, "HTTP-testing", "bytemap-allow")
+	if err != nil {
+		t.Fatal("Error opening bytemap file " + err.Error())
+	}
+	if bytemap.GetIndex() != -1 || bytemap.Pending() {
+		t.Error("New bytemap should start before the first record", bytemap.GetIndex())
+	}
+
+	bytemap.ProcessBytes(&Record{Index: 0, Data: []byte("GET /")})
+	if !bytemap.Pending() {
+		t.Error("Processed record is not pending")
+	}
+	bytemap.Save()
+	if bytemap.Pending() {
+		t.Error("Saved record is still pending")
+	}
+
+	bytemap, err = NewBytemapFile(root, "HTTP-testing", "bytemap-allow")
+	if err != nil {
+		t.Fatal("Error reopening bytemap file " + err.Error())
+	}
+	if bytemap.GetIndex() != 0 || !bytes.Equal(bytemap.Extract(), []byte("GET /")) {
+		t.Error("Wrong bytemap", bytemap.GetIndex(), bytemap.Extract())
+	}
+
+	_, err = os.Stat(root.File("HTTP-testing", "bytemap"))
+	if !os.IsNotExist(err) {
+		t.Error("Bytemap was saved to the wrong file")
+	}
 }
@@ -1,17 +1,21 @@
 package storage
 
 import (
+	"sync"
+
 	"github.com/orcaman/concurrent-map"
 )
 
 // A concurrent map that has dataset names (i.e. dataset1-incoming) as keys and
-// pointers to Stores as values.
+// pointers to Stores as values.  All of the stores are in the cache's Root.
 type StoreCache struct {
 	cmap.ConcurrentMap
+	Root *Root
+	lock sync.Mutex // held while opening a store so that each store is only opened once
 }
 
-func NewStoreCache() *StoreCache {
-	return &StoreCache{cmap.New()}
+func NewStoreCache(root *Root) *StoreCache {
+	return &StoreCache{ConcurrentMap: cmap.New(), Root: root}
 }
 
 func (self *StoreCache) Get(name string) *Store {
@@ -26,3 +30,23 @@ func (self *StoreCache) Get(name string) *Store {
 func (self *StoreCache) Put(name string, store *Store) {
 	self.ConcurrentMap.Set(name, store)
 }
+
+// Return the cached store with the given name, opening it in the cache's Root if needed.
+func (self *StoreCache) Open(name string) (*Store, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	store := self.Get(name)
+	if store != nil {
+		return store, nil
+	}
+
+	store, err := OpenStore(self.Root, name)
+	if err != nil {
+		return nil, err
+	}
+
+	self.Put(name, store)
+
+	return store, nil
+}
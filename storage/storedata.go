@@ -2,28 +2,35 @@ package storage
 
 import (
 	"encoding/binary"
-	"fmt"
+	"io"
 	"os"
 )
 
-// StoreData contains data derived from inputs
+// StoreData contains data derived from inputs.  It was saved by servers that checkpointed
+// processed records in the store's derived file instead of in the countmap, and is only
+// loaded to carry that checkpoint over.
 type StoreData struct {
-	Last int64
+	Last int64 // index of the last record that has been processed, -1 if none have
 }
 
-// Save saves StoreData to storage
-func (self *StoreData) Save(path string) error {
-	fmt.Println("Saving...", self.Last)
-	output, err := os.OpenFile("store/"+path+"/derived", os.O_WRONLY|os.O_CREATE, 0666)
-	if err != nil {
-		return err
+// LoadStoreData loads the StoreData saved for a store.  A store that has never been
+// saved has not had any records processed yet.
+func LoadStoreData(root *Root, path string) (*StoreData, error) {
+	input, err := os.Open(root.File(path, "derived"))
+	if os.IsNotExist(err) {
+		return &StoreData{Last: -1}, nil
+	} else if err != nil {
+		return nil, err
 	}
+	defer input.Close()
 
 	buff := make([]byte, 8)
-	binary.PutVarint(buff, self.Last)
-	output.Write(buff)
+	_, err = io.ReadFull(input, buff)
+	if err != nil {
+		return nil, err
+	}
 
-	output.Close()
+	last, _ := binary.Varint(buff)
 
-	return nil
+	return &StoreData{Last: last}, nil
 }
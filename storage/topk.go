@@ -0,0 +1,240 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+)
+
+// TopK keeps the best K rule candidates for a dataset, best first.  The scores of candidates
+// change as the totals grow, but rescoring all of them for every count would be slow, so only the
+// candidate whose count changed is moved when it's offered and the rest are rescored when the
+// counts are flushed.  The training service adds candidates while the rule query reads them, so
+// access is locked.
+type TopK struct {
+	path       string           // Path of the topk file
+	k          int              // Most candidates that are kept
+	candidates []*RuleCandidate // Best candidates, best first
+	lock       sync.Mutex
+}
+
+// description of topk file:
+// 4 bytes of magic ("ALTK"), 4 bytes for the format version, 8 bytes for the number of
+// candidates, then for each candidate, best first: 8 bytes each for the index, allow count,
+// allow total, block count and block total.
+// All values are little endian.  The counts are also in the countmap, where they are read from
+// when the countmap is opened, but the rule service only reads this file.
+
+func NewTopK(path string, k int) *TopK {
+	return &TopK{path: path, k: k}
+}
+
+// Add candidate if it's one of the best K, or update it if it's already kept, and move it to its
+// place.  Candidates with a score of 0 aren't kept.  Returns true if the candidates changed order
+// or membership.
+func (self *TopK) Offer(candidate *RuleCandidate) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	position := -1
+	for i, current := range self.candidates {
+		if current.Index == candidate.Index {
+			position = i
+			break
+		}
+	}
+
+	changed := false
+	if position < 0 {
+		if candidate.Score() == 0 || self.k <= 0 {
+			return false
+		}
+
+		if len(self.candidates) < self.k {
+			self.candidates = append(self.candidates, candidate)
+		} else if ranksBefore(candidate, self.candidates[len(self.candidates)-1]) {
+			self.candidates[len(self.candidates)-1] = candidate
+		} else {
+			return false
+		}
+		position = len(self.candidates) - 1
+		changed = true
+	} else if candidate.Score() == 0 {
+		self.candidates = append(self.candidates[:position], self.candidates[position+1:]...)
+		return true
+	} else {
+		self.candidates[position] = candidate
+	}
+
+	// The other candidates are still in order, so one insertion step puts this one in its place.
+	for position > 0 && ranksBefore(self.candidates[position], self.candidates[position-1]) {
+		self.candidates[position], self.candidates[position-1] = self.candidates[position-1], self.candidates[position]
+		position--
+		changed = true
+	}
+	for position+1 < len(self.candidates) && ranksBefore(self.candidates[position+1], self.candidates[position]) {
+		self.candidates[position], self.candidates[position+1] = self.candidates[position+1], self.candidates[position]
+		position++
+		changed = true
+	}
+
+	return changed
+}
+
+// Rescore all of the candidates that are kept with the current counts and put them back in order.
+func (self *TopK) Rescore(rescore func(index int64) *RuleCandidate) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	candidates := make([]*RuleCandidate, len(self.candidates))
+	for i, current := range self.candidates {
+		candidates[i] = rescore(current.Index)
+	}
+
+	self.candidates = self.rank(candidates)
+}
+
+// Returns a copy of the best candidates, best first.
+func (self *TopK) Candidates() []*RuleCandidate {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	result := make([]*RuleCandidate, len(self.candidates))
+	copy(result, self.candidates)
+	return result
+}
+
+// Sort the candidates best first, dropping the ones with a score of 0 and any past K.
+func (self *TopK) rank(candidates []*RuleCandidate) []*RuleCandidate {
+	result := make([]*RuleCandidate, 0, len(candidates))
+	for _, candidate := range candidates {
+		if candidate.Score() != 0 {
+			result = append(result, candidate)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return ranksBefore(result[i], result[j])
+	})
+
+	if len(result) > self.k {
+		result = result[:self.k]
+	}
+
+	return result
+}
+
+// True if a goes before b.  Ties go to the sequence that was seen first.
+func ranksBefore(a *RuleCandidate, b *RuleCandidate) bool {
+	if a.Score() != b.Score() {
+		return a.BetterThan(b)
+	}
+	return a.Index < b.Index
+}
+
+// Write the candidates to disk.  The new file is written next to the old one and then swapped in.
+func (self *TopK) Save() error {
+	candidates := self.Candidates()
+
+	data := make([]byte, topkHeaderSize+(int64(len(candidates))*topkEntrySize))
+	copy(data[0:4], topkMagic)
+	binary.LittleEndian.PutUint32(data[4:8], topkVersion)
+	binary.LittleEndian.PutUint64(data[8:16], uint64(len(candidates)))
+	for i, candidate := range candidates {
+		entry := data[topkHeaderSize+(int64(i)*topkEntrySize):]
+		binary.LittleEndian.PutUint64(entry[0:], uint64(candidate.Index))
+		binary.LittleEndian.PutUint64(entry[8:], uint64(candidate.AllowCount))
+		binary.LittleEndian.PutUint64(entry[16:], uint64(candidate.AllowTotal))
+		binary.LittleEndian.PutUint64(entry[24:], uint64(candidate.BlockCount))
+		binary.LittleEndian.PutUint64(entry[32:], uint64(candidate.BlockTotal))
+	}
+
+	err := writeSynced(self.path+".new", data)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(self.path+".new", self.path)
+}
+
+// Read the candidates from disk and score them with the current counts.  A missing file leaves
+// no candidates.
+func (self *TopK) Load(rescore func(index int64) *RuleCandidate) error {
+	saved, err := readTopK(self.path)
+	if err != nil {
+		return err
+	}
+
+	candidates := make([]*RuleCandidate, len(saved))
+	for i, candidate := range saved {
+		candidates[i] = rescore(candidate.Index)
+	}
+
+	self.lock.Lock()
+	self.candidates = self.rank(candidates)
+	self.lock.Unlock()
+
+	return nil
+}
+
+// Read the best candidates that were saved for a countmap (i.e. "dataset1-incoming-offsets-sequence"),
+// best first, with the counts they had when they were saved.  Used by the rule service, which
+// doesn't have the counts.  Returns no candidates if none have been saved.
+func LoadTopCandidates(root *Root, name string, scorer Scorer) ([]*RuleCandidate, error) {
+	candidates, err := readTopK(root.File(name, "topk"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, candidate := range candidates {
+		candidate.scorer = scorer
+	}
+
+	return candidates, nil
+}
+
+func readTopK(path string) ([]*RuleCandidate, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if int64(len(data)) < topkHeaderSize || string(data[0:4]) != topkMagic {
+		return nil, errors.New("Not a topk file: " + path)
+	}
+
+	// Version 1 files only had the index of each candidate.
+	entrySize := topkEntrySize
+	version := binary.LittleEndian.Uint32(data[4:8])
+	if version == 1 {
+		entrySize = int64Size
+	} else if version != topkVersion {
+		return nil, fmt.Errorf("Unsupported topk version %d in %s", version, path)
+	}
+
+	count := int64(binary.LittleEndian.Uint64(data[8:16]))
+	if count < 0 || topkHeaderSize+(count*entrySize) > int64(len(data)) {
+		return nil, errors.New("Truncated topk file: " + path)
+	}
+
+	candidates := make([]*RuleCandidate, count)
+	for i := range candidates {
+		entry := data[topkHeaderSize+(int64(i)*entrySize):]
+		candidate := &RuleCandidate{Index: int64(binary.LittleEndian.Uint64(entry[0:]))}
+		if version != 1 {
+			candidate.AllowCount = int64(binary.LittleEndian.Uint64(entry[8:]))
+			candidate.AllowTotal = int64(binary.LittleEndian.Uint64(entry[16:]))
+			candidate.BlockCount = int64(binary.LittleEndian.Uint64(entry[24:]))
+			candidate.BlockTotal = int64(binary.LittleEndian.Uint64(entry[32:]))
+		}
+		candidates[i] = candidate
+	}
+
+	return candidates, nil
+}
@@ -0,0 +1,60 @@
+package storage
+
+import "testing"
+
+// A candidate seen in count of 100 blocked packets and none of 100 allowed ones.
+func blockCandidate(index int64, count int64) *RuleCandidate {
+	return &RuleCandidate{Index: index, AllowCount: 0, AllowTotal: 100, BlockCount: count, BlockTotal: 100}
+}
+
+func topIndices(top *TopK) []int64 {
+	var result []int64
+	for _, candidate := range top.Candidates() {
+		result = append(result, candidate.Index)
+	}
+	return result
+}
+
+func TestTopKOffer(t *testing.T) {
+	top := NewTopK("", 3)
+
+	offers := []struct {
+		candidate *RuleCandidate
+		changed   bool
+		expected  []int64
+	}{
+		{blockCandidate(0, 50), true, []int64{0}},
+		{blockCandidate(1, 70), true, []int64{1, 0}},
+		{blockCandidate(2, 60), true, []int64{1, 2, 0}},
+		{blockCandidate(3, 40), false, []int64{1, 2, 0}}, // not one of the best 3
+		{blockCandidate(3, 55), true, []int64{1, 2, 3}},  // replaces the worst
+		{blockCandidate(2, 61), false, []int64{1, 2, 3}}, // better, but still in the same place
+		{blockCandidate(3, 90), true, []int64{3, 1, 2}},  // moves up past the others
+		{blockCandidate(3, 56), true, []int64{1, 2, 3}},  // and back down
+		{blockCandidate(1, 0), true, []int64{2, 3}},      // no longer a rule
+		{blockCandidate(4, 56), true, []int64{2, 3, 4}},  // ties go to the sequence seen first
+	}
+
+	for i, offer := range offers {
+		changed := top.Offer(offer.candidate)
+		indices := topIndices(top)
+		if changed != offer.changed || len(indices) != len(offer.expected) {
+			t.Fatal("Wrong candidates after offer", i, changed, indices)
+		}
+		for j := range indices {
+			if indices[j] != offer.expected[j] {
+				t.Fatal("Wrong candidates after offer", i, indices)
+			}
+		}
+	}
+
+	// Rescoring puts the candidates back in order with their current counts.
+	counts := map[int64]int64{2: 10, 3: 80, 4: 70}
+	top.Rescore(func(index int64) *RuleCandidate {
+		return blockCandidate(index, counts[index])
+	})
+	indices := topIndices(top)
+	if len(indices) != 3 || indices[0] != 3 || indices[1] != 4 || indices[2] != 2 {
+		t.Error("Wrong candidates after rescoring", indices)
+	}
+}